@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const proxyAuthRealm = "ja3proxy"
+
+type UserStore struct {
+	mu       sync.RWMutex
+	hashes   map[string][]byte
+	verified map[string][sha256.Size]byte
+}
+
+func (s *UserStore) Authenticate(user, password string) bool {
+	if s == nil {
+		return true
+	}
+	digest := sha256.Sum256([]byte(password))
+
+	s.mu.RLock()
+	hash, ok := s.hashes[user]
+	cached, cachedOK := s.verified[user]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if cachedOK && subtle.ConstantTimeCompare(cached[:], digest[:]) == 1 {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.hashes[user]; ok && bytes.Equal(current, hash) {
+		s.verified[user] = digest
+	}
+	return true
+}
+
+// Has reports whether user is in the store.
+func (s *UserStore) Has(user string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.hashes[user]
+	return ok
+}
+
+func (s *UserStore) Set(hashes map[string][]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hashes = hashes
+	s.verified = make(map[string][sha256.Size]byte)
+}
+
+func loadCredentialsFile(path string) (map[string][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashes := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" || hash == "" {
+			return nil, fmt.Errorf("line %d: want user:bcrypt-hash", lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: user %s: %w", lineNumber, user, err)
+		}
+		hashes[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+func (s *UserStore) ApplyFile(path string) error {
+	hashes, err := loadCredentialsFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.Set(hashes)
+	log.Printf("loaded %d proxy users from %s", len(hashes), path)
+	return nil
+}
+
+func (s *UserStore) WatchFile(ctx context.Context, path string, interval time.Duration) error {
+	return watchFiles(ctx, interval, "proxy credentials", func() []string {
+		return []string{path}
+	}, func() error {
+		return s.ApplyFile(path)
+	})
+}
+
+func parseProxyBasicAuth(header string) (string, string, bool) {
+	scheme, encoded, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Basic") {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// authorizeHTTP checks the client's proxy credentials and returns the request
+// context with the upstream credentials and session they select.
+func (p *Proxy) authorizeHTTP(w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	if p == nil || (p.users == nil && p.sessions == nil && !p.forwardsCredentials()) {
+		return r.Context(), true
+	}
+
+	user, password, ok := parseProxyBasicAuth(r.Header.Get("Proxy-Authorization"))
+	if ok && p.users.Authenticate(p.baseUser(user), password) {
+		ctx, err := p.clientContext(r.Context(), user, password)
+		if err == nil {
+			return ctx, true
+		}
+		log.Printf("proxy authentication failed for %s: %v", r.RemoteAddr, err)
+	} else if p.users == nil && !p.forwardsCredentials() {
+		return r.Context(), true
+	} else {
+		log.Printf("proxy authentication failed for %s", r.RemoteAddr)
+	}
+
+	w.Header().Set("Proxy-Authenticate", fmt.Sprintf("Basic realm=%q", proxyAuthRealm))
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	return nil, false
+}
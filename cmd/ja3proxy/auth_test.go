@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestUserStore(t *testing.T, users map[string]string) *UserStore {
+	t.Helper()
+
+	hashes := make(map[string][]byte, len(users))
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("bcrypt: %v", err)
+		}
+		hashes[user] = hash
+	}
+	store := &UserStore{}
+	store.Set(hashes)
+	return store
+}
+
+func TestLoadCredentialsFile(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("bcrypt: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	content := "# proxy users\n\nalice:" + string(hash) + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write credentials: %v", err)
+	}
+
+	store := &UserStore{}
+	if err := store.ApplyFile(path); err != nil {
+		t.Fatalf("ApplyFile() error = %v", err)
+	}
+	if !store.Authenticate("alice", "secret") {
+		t.Fatal("Authenticate(alice, secret) = false, want true")
+	}
+	if !store.Authenticate("alice", "secret") {
+		t.Fatal("cached Authenticate(alice, secret) = false, want true")
+	}
+	if store.Authenticate("alice", "wrong") {
+		t.Fatal("Authenticate(alice, wrong) = true, want false")
+	}
+	if store.Authenticate("bob", "secret") {
+		t.Fatal("Authenticate(bob, secret) = true, want false")
+	}
+
+	for _, invalid := range []string{"alice\n", "alice:plaintext\n"} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatalf("write credentials: %v", err)
+		}
+		if _, err := loadCredentialsFile(path); err == nil {
+			t.Fatalf("loadCredentialsFile(%q) error = nil, want error", invalid)
+		}
+	}
+}
+
+func TestUserStoreSetInvalidatesVerifiedCache(t *testing.T) {
+	store := newTestUserStore(t, map[string]string{"alice": "old"})
+	if !store.Authenticate("alice", "old") {
+		t.Fatal("Authenticate(alice, old) = false, want true")
+	}
+
+	updated := newTestUserStore(t, map[string]string{"alice": "new"})
+	store.Set(updated.hashes)
+	if store.Authenticate("alice", "old") {
+		t.Fatal("Authenticate(alice, old) after reload = true, want false")
+	}
+	if !store.Authenticate("alice", "new") {
+		t.Fatal("Authenticate(alice, new) after reload = false, want true")
+	}
+}
+
+func TestServeHTTPRequiresProxyAuthorization(t *testing.T) {
+	var forwarded *http.Request
+	proxy := NewProxy(nil, nil, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		forwarded = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}))
+	proxy.users = newTestUserStore(t, map[string]string{"alice": "secret"})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if rec.Code != http.StatusProxyAuthRequired {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusProxyAuthRequired)
+	}
+	if got := rec.Header().Get("Proxy-Authenticate"); got != `Basic realm="ja3proxy"` {
+		t.Fatalf("Proxy-Authenticate = %q, want Basic realm", got)
+	}
+	if forwarded != nil {
+		t.Fatal("unauthenticated request was forwarded")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if forwarded == nil {
+		t.Fatal("authenticated request was not forwarded")
+	}
+	if got := forwarded.Header.Get("Proxy-Authorization"); got != "" {
+		t.Fatalf("forwarded Proxy-Authorization = %q, want stripped", got)
+	}
+}
+
+func TestHandleSOCKS5UserPassAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		status   byte
+	}{
+		{name: "valid credentials", password: "secret", status: socks5AuthSuccess},
+		{name: "invalid credentials", password: "wrong", status: socks5AuthFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			if err := clientConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				t.Fatalf("set deadline: %v", err)
+			}
+
+			dialed := make(chan string, 1)
+			proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+				dialed <- addr
+				return nil, io.EOF
+			}, nil, nil)
+			proxy.users = newTestUserStore(t, map[string]string{"alice": "secret"})
+			go proxy.handleSOCKS5(serverConn)
+
+			writeSOCKS5Greeting(t, clientConn, socks5NoAuth)
+			readExact(t, clientConn, []byte{socks5Version, socks5NoAcceptable})
+
+			clientConn, serverConn = net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+			if err := clientConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+				t.Fatalf("set deadline: %v", err)
+			}
+			go proxy.handleSOCKS5(serverConn)
+
+			writeSOCKS5Greeting(t, clientConn, socks5UserPass)
+			readExact(t, clientConn, []byte{socks5Version, socks5UserPass})
+			writeSOCKS5UserPass(t, clientConn, "alice", tt.password)
+			readExact(t, clientConn, []byte{socks5AuthVersion, tt.status})
+			if tt.status != socks5AuthSuccess {
+				return
+			}
+
+			writeSOCKS5ConnectRequest(t, clientConn, "example.com", 80)
+			readExact(t, clientConn, []byte{socks5Version, socks5GeneralFail, socks5Reserved, socks5IPv4, 0, 0, 0, 0, 0, 0})
+			if addr := <-dialed; addr != "example.com:80" {
+				t.Fatalf("dial addr = %q, want example.com:80", addr)
+			}
+		})
+	}
+}
+
+func writeSOCKS5UserPass(t *testing.T, conn net.Conn, user, password string) {
+	t.Helper()
+	request := []byte{socks5AuthVersion, byte(len(user))}
+	request = append(request, user...)
+	request = append(request, byte(len(password)))
+	request = append(request, password...)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("write SOCKS5 user/pass: %v", err)
+	}
+}
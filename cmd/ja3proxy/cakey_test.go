@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptDecryptPKCS8RoundTrip(t *testing.T) {
+	der := []byte("private key bytes that are not block aligned")
+
+	encrypted, err := encryptPKCS8(der, []byte("secret"))
+	if err != nil {
+		t.Fatalf("encryptPKCS8() error = %v", err)
+	}
+	got, err := decryptPKCS8(encrypted, []byte("secret"))
+	if err != nil {
+		t.Fatalf("decryptPKCS8() error = %v", err)
+	}
+	if !bytes.Equal(got, der) {
+		t.Fatalf("decrypted = %q, want %q", got, der)
+	}
+
+	if _, err := decryptPKCS8(encrypted, []byte("wrong")); err == nil {
+		t.Fatal("decryptPKCS8() with wrong passphrase error = nil, want error")
+	}
+}
+
+func TestReadPassphrase(t *testing.T) {
+	t.Setenv("JA3PROXY_TEST_PASSPHRASE", "from-env")
+	path := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatalf("write passphrase: %v", err)
+	}
+
+	tests := []struct {
+		source string
+		want   string
+	}{
+		{source: "", want: ""},
+		{source: "env:JA3PROXY_TEST_PASSPHRASE", want: "from-env"},
+		{source: "file:" + path, want: "from-file"},
+	}
+	for _, tt := range tests {
+		got, err := readPassphrase(tt.source)
+		if err != nil {
+			t.Fatalf("readPassphrase(%q) error = %v", tt.source, err)
+		}
+		if string(got) != tt.want {
+			t.Fatalf("readPassphrase(%q) = %q, want %q", tt.source, got, tt.want)
+		}
+	}
+
+	for _, source := range []string{"env:JA3PROXY_TEST_MISSING", "secret"} {
+		if _, err := readPassphrase(source); err == nil {
+			t.Fatalf("readPassphrase(%q) error = nil, want error", source)
+		}
+	}
+}
+
+func TestGenerateEncryptedCAAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+	passphrase := []byte("secret")
+
+	ca := CertificateAuthority{}
+	if err := ca.GenerateEncrypted(certPath, keyPath, passphrase); err != nil {
+		t.Fatalf("CertificateAuthority.GenerateEncrypted() error = %v", err)
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatalf("read key: %v", err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != encryptedPrivateKeyType {
+		t.Fatalf("key PEM type = %v, want %s", block, encryptedPrivateKeyType)
+	}
+
+	if err := (&CertificateAuthority{}).Load(certPath, keyPath); err == nil {
+		t.Fatal("CertificateAuthority.Load() without passphrase error = nil, want error")
+	}
+	err = (&CertificateAuthority{}).LoadEncrypted(certPath, keyPath, []byte("wrong"))
+	if err == nil || !strings.Contains(err.Error(), "decrypt CA key") {
+		t.Fatalf("LoadEncrypted() with wrong passphrase error = %v, want decrypt error", err)
+	}
+
+	loaded := CertificateAuthority{}
+	if err := loaded.LoadEncrypted(certPath, keyPath, passphrase); err != nil {
+		t.Fatalf("CertificateAuthority.LoadEncrypted() error = %v", err)
+	}
+	if !loaded.x509Cert.Equal(ca.x509Cert) {
+		t.Fatal("loaded CA certificate does not match generated certificate")
+	}
+	if _, err := x509.MarshalPKCS8PrivateKey(loaded.tlsCert.PrivateKey); err != nil {
+		t.Fatalf("loaded CA private key is unusable: %v", err)
+	}
+}
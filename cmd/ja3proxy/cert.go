@@ -5,6 +5,7 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -12,6 +13,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	cfconfig "github.com/cloudflare/cfssl/config"
@@ -22,29 +24,27 @@ import (
 )
 
 func (ca *CertificateAuthority) Generate(certPath, keyPath string) error {
-	csr := cfsr.CertificateRequest{
-		CN:         "ja3proxy CA",
-		KeyRequest: cfsr.NewKeyRequest(),
-	}
-
-	certPEM, _, keyPEM, err := initca.New(&csr)
-	if err != nil {
-		return err
-	}
+	return ca.GenerateEncrypted(certPath, keyPath, nil)
+}
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+func (ca *CertificateAuthority) GenerateEncrypted(certPath, keyPath string, passphrase []byte) error {
+	certPEM, keyPEM, err := ca.generateInMemory()
 	if err != nil {
 		return err
 	}
 
-	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
-	if err != nil {
-		return err
+	if len(passphrase) > 0 {
+		der, err := x509.MarshalPKCS8PrivateKey(ca.tlsCert.PrivateKey)
+		if err != nil {
+			return err
+		}
+		encrypted, err := encryptPKCS8(der, passphrase)
+		if err != nil {
+			return err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: encryptedPrivateKeyType, Bytes: encrypted})
 	}
 
-	ca.tlsCert = tlsCert
-	ca.x509Cert = x509Cert
-
 	if err := ensureParentDir(certPath); err != nil {
 		return err
 	}
@@ -75,6 +75,73 @@ func (ca *CertificateAuthority) Generate(certPath, keyPath string) error {
 	return nil
 }
 
+func (ca *CertificateAuthority) generateInMemory() ([]byte, []byte, error) {
+	csr := cfsr.CertificateRequest{
+		CN:         "ja3proxy CA",
+		KeyRequest: cfsr.NewKeyRequest(),
+	}
+
+	certPEM, _, keyPEM, err := initca.New(&csr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ca.tlsCert = tlsCert
+	ca.x509Cert = x509Cert
+
+	return certPEM, keyPEM, nil
+}
+
+func (ca *CertificateAuthority) CertificatePEM() ([]byte, error) {
+	if ca.x509Cert == nil {
+		return nil, fmt.Errorf("CA certificate has not been loaded")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.x509Cert.Raw}), nil
+}
+
+func (ca *CertificateAuthority) ExportCertificate(target string) error {
+	certPEM, err := ca.CertificatePEM()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case target == "" || target == "stdout":
+		_, err = os.Stdout.Write(certPEM)
+		return err
+	case strings.HasPrefix(target, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if err != nil || fd < 0 {
+			return fmt.Errorf("invalid file descriptor %q", target)
+		}
+		out := os.NewFile(uintptr(fd), target)
+		if out == nil {
+			return fmt.Errorf("invalid file descriptor %q", target)
+		}
+		defer out.Close()
+		_, err = out.Write(certPEM)
+		return err
+	case strings.HasPrefix(target, "file:"):
+		path := strings.TrimPrefix(target, "file:")
+		if err := ensureParentDir(path); err != nil {
+			return err
+		}
+		return os.WriteFile(path, certPEM, 0644)
+	default:
+		return fmt.Errorf("unsupported CA export target %q, want stdout, fd:N or file:PATH", target)
+	}
+}
+
 func ensureParentDir(path string) error {
 	dir := filepath.Dir(path)
 	if dir == "." || dir == "" {
@@ -102,6 +169,31 @@ func (session *SessionKeyHelper) Generate() error {
 	return nil
 }
 
+func (session *SessionKeyHelper) GenerateRSA() error {
+	privKey, err := rsa.GenerateKey(rand.Reader, leafRSAKeyBits)
+	if err != nil {
+		return err
+	}
+
+	PEMBlock := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privKey)})
+
+	session.privateKey = privKey
+	session.PEMBlock = PEMBlock
+
+	return nil
+}
+
+func (session *SessionKeyHelper) GenerateType(keyType LeafKeyType) error {
+	switch keyType {
+	case LeafKeyECDSA:
+		return session.Generate()
+	case LeafKeyRSA:
+		return session.GenerateRSA()
+	default:
+		return fmt.Errorf("unsupported leaf key type %q", keyType)
+	}
+}
+
 // Credit: elazarl/goproxy (https://github.com/elazarl/goproxy/blob/7cc037d33fb57d20c2fa7075adaf0e2d2862da78/https.go#L50)
 func stripPort(s string) string {
 	host, _, err := net.SplitHostPort(s)
@@ -166,18 +258,63 @@ func (ca *CertificateAuthority) GenerateCertificate(session SessionKeyHelper, sn
 }
 
 func (ca *CertificateAuthority) Load(certPath, keyPath string) error {
-	tlsCert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	return ca.LoadEncrypted(certPath, keyPath, nil)
+}
+
+func (ca *CertificateAuthority) LoadEncrypted(certPath, keyPath string, passphrase []byte) error {
+	certPEM, err := os.ReadFile(certPath)
 	if err != nil {
 		return err
-	} else {
-		x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
-		if err != nil {
-			return err
-		}
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	keyPEM, err = decryptPrivateKeyPEM(keyPEM, passphrase)
+	if err != nil {
+		return err
+	}
 
-		ca.tlsCert = tlsCert
-		ca.x509Cert = x509Cert
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	x509Cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return err
+	}
 
-		return nil
+	ca.tlsCert = tlsCert
+	ca.x509Cert = x509Cert
+
+	return nil
+}
+
+func (ca *CertificateAuthority) LoadWithSigner(certPath string, signer crypto.Signer) error {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("failed to decode CA certificate PEM")
+	}
+	x509Cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
 	}
+
+	publicKey, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(x509Cert.PublicKey) {
+		return fmt.Errorf("signer public key does not match CA certificate")
+	}
+
+	ca.tlsCert = tls.Certificate{
+		Certificate: [][]byte{block.Bytes},
+		PrivateKey:  signer,
+		Leaf:        x509Cert,
+	}
+	ca.x509Cert = x509Cert
+
+	return nil
 }
@@ -178,3 +178,16 @@ func TestGenerateCAWithRootRelativePaths(t *testing.T) {
 		t.Fatalf("expected generated root-relative CA key file: %v", err)
 	}
 }
+
+func TestExportCertificateRejectsUnknownTarget(t *testing.T) {
+	ca := CertificateAuthority{}
+	if _, _, err := ca.generateInMemory(); err != nil {
+		t.Fatalf("generateInMemory() error = %v", err)
+	}
+
+	for _, target := range []string{"admin", "fd:-1", "fd:x"} {
+		if err := ca.ExportCertificate(target); err == nil {
+			t.Fatalf("ExportCertificate(%q) error = nil, want error", target)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CertOverride struct {
+	Host string `json:"host"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+type loadedCertOverride struct {
+	pattern string
+	cert    tls.Certificate
+}
+
+type CertOverrideStore struct {
+	mu        sync.RWMutex
+	overrides []loadedCertOverride
+	files     []string
+}
+
+func (s *CertOverrideStore) Lookup(host string) (tls.Certificate, bool) {
+	if s == nil {
+		return tls.Certificate{}, false
+	}
+	host = strings.ToLower(stripPort(host))
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, override := range s.overrides {
+		if matchHostPattern(override.pattern, host) {
+			return override.cert, true
+		}
+	}
+	return tls.Certificate{}, false
+}
+
+func (s *CertOverrideStore) set(overrides []loadedCertOverride, files []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.overrides = overrides
+	s.files = files
+}
+
+func (s *CertOverrideStore) watchedFiles() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]string{}, s.files...)
+}
+
+func matchHostPattern(pattern string, host string) bool {
+	if pattern == host {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return false
+}
+
+func loadCertOverrideFile(path string) ([]loadedCertOverride, []string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entries []CertOverride
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, nil, err
+	}
+
+	baseDir := filepath.Dir(path)
+	overrides := make([]loadedCertOverride, 0, len(entries))
+	files := []string{path}
+	for i, entry := range entries {
+		if entry.Host == "" {
+			return nil, nil, fmt.Errorf("override %d: host is required", i)
+		}
+		if entry.Cert == "" || entry.Key == "" {
+			return nil, nil, fmt.Errorf("override %s: cert and key are required", entry.Host)
+		}
+
+		certPath := resolveConfigPath(baseDir, entry.Cert)
+		keyPath := resolveConfigPath(baseDir, entry.Key)
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("override %s: %w", entry.Host, err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("override %s: %w", entry.Host, err)
+		}
+		cert.Leaf = leaf
+
+		overrides = append(overrides, loadedCertOverride{
+			pattern: strings.ToLower(entry.Host),
+			cert:    cert,
+		})
+		files = append(files, certPath, keyPath)
+	}
+	return overrides, files, nil
+}
+
+func resolveConfigPath(baseDir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+func (s *CertOverrideStore) ApplyFile(path string) error {
+	overrides, files, err := loadCertOverrideFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.set(overrides, files)
+	log.Printf("loaded %d certificate overrides from %s", len(overrides), path)
+	return nil
+}
+
+func (s *CertOverrideStore) WatchFile(ctx context.Context, path string, interval time.Duration) error {
+	return watchFiles(ctx, interval, "certificate overrides", s.watchedFiles, func() error {
+		return s.ApplyFile(path)
+	})
+}
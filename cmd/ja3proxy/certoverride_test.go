@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{pattern: "api.example", host: "api.example", want: true},
+		{pattern: "api.example", host: "www.api.example", want: false},
+		{pattern: "*.example", host: "api.example", want: true},
+		{pattern: "*.example", host: "a.b.example", want: true},
+		{pattern: "*.example", host: "example", want: false},
+		{pattern: "*.example", host: "badexample", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := matchHostPattern(tt.pattern, tt.host); got != tt.want {
+			t.Fatalf("matchHostPattern(%q, %q) = %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestCertOverrideStoreLookup(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "internal", "internal.example")
+	writeCertOverrideConfig(t, dir, `[
+		{"host": "*.Internal.Example", "cert": "internal.pem", "key": "internal-key.pem"}
+	]`)
+
+	store := &CertOverrideStore{}
+	if err := store.ApplyFile(filepath.Join(dir, "overrides.json")); err != nil {
+		t.Fatalf("ApplyFile() error = %v", err)
+	}
+
+	cert, ok := store.Lookup("api.internal.example:443")
+	if !ok {
+		t.Fatal("Lookup() ok = false, want true")
+	}
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "internal.example" {
+		t.Fatalf("override leaf = %v, want internal.example", cert.Leaf)
+	}
+	if _, ok := store.Lookup("public.example"); ok {
+		t.Fatal("Lookup(public.example) ok = true, want false")
+	}
+}
+
+func TestCertOverrideStoreRejectsMismatchedKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "a", "a.example")
+	writeTestKeyPair(t, dir, "b", "b.example")
+	writeCertOverrideConfig(t, dir, `[{"host": "a.example", "cert": "a.pem", "key": "b-key.pem"}]`)
+
+	err := (&CertOverrideStore{}).ApplyFile(filepath.Join(dir, "overrides.json"))
+	if err == nil {
+		t.Fatal("ApplyFile() error = nil, want key mismatch error")
+	}
+	if !strings.Contains(err.Error(), "a.example") {
+		t.Fatalf("error = %q, want host context", err)
+	}
+}
+
+func TestCertOverrideStoreWatchReloadsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "site", "first.example")
+	writeCertOverrideConfig(t, dir, `[{"host": "site.example", "cert": "site.pem", "key": "site-key.pem"}]`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := &CertOverrideStore{}
+	if err := store.WatchFile(ctx, filepath.Join(dir, "overrides.json"), 10*time.Millisecond); err != nil {
+		t.Fatalf("WatchFile() error = %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	writeTestKeyPair(t, dir, "site", "second.example")
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, ok := store.Lookup("site.example")
+		if ok && cert.Leaf.Subject.CommonName == "second.example" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("certificate override was not reloaded")
+}
+
+func TestCertificateForClientPrefersOverride(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "static", "static.example")
+	writeCertOverrideConfig(t, dir, `[{"host": "static.example", "cert": "static.pem", "key": "static-key.pem"}]`)
+	overrides := &CertOverrideStore{}
+	if err := overrides.ApplyFile(filepath.Join(dir, "overrides.json")); err != nil {
+		t.Fatalf("ApplyFile() error = %v", err)
+	}
+
+	handler := &TunnelHandler{CertOverrides: overrides}
+	cert, err := handler.certificateForClient("static.example", nil)
+	if err != nil {
+		t.Fatalf("certificateForClient() error = %v", err)
+	}
+	if cert.Leaf.Subject.CommonName != "static.example" {
+		t.Fatalf("certificate CN = %q, want static.example", cert.Leaf.Subject.CommonName)
+	}
+	if _, err := handler.certificateForClient("other.example", nil); err == nil {
+		t.Fatal("certificateForClient() without CA error = nil, want CA error")
+	}
+}
+
+func writeCertOverrideConfig(t *testing.T, dir string, content string) {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, "overrides.json"), []byte(content), 0600); err != nil {
+		t.Fatalf("write overrides: %v", err)
+	}
+}
+
+func writeTestKeyPair(t *testing.T, dir string, name string, commonName string) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{commonName},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("parse key pair: %v", err)
+	}
+	return cert
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	tlsRecordHeaderSize   = 5
+	tlsMaxRecordSize      = 16384 + 2048
+	tlsClientHelloType    = 0x01
+	tlsServerNameExt      = 0x0000
+	tlsServerNameHostName = 0x00
+	clientHelloReaderSize = tlsRecordHeaderSize + tlsMaxRecordSize
+	clientHelloTimeout    = 5 * time.Second
+)
+
+var errNoClientHello = errors.New("not a TLS ClientHello")
+
+func peekClientHelloSNI(reader *bufio.Reader) (string, error) {
+	header, err := reader.Peek(tlsRecordHeaderSize)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != tlsHandshakeRecord {
+		return "", errNoClientHello
+	}
+	recordSize := int(binary.BigEndian.Uint16(header[3:5]))
+	if recordSize > tlsMaxRecordSize {
+		return "", fmt.Errorf("TLS record too large: %d", recordSize)
+	}
+
+	record, err := reader.Peek(tlsRecordHeaderSize + recordSize)
+	if err != nil {
+		return "", err
+	}
+	return parseClientHelloSNI(record[tlsRecordHeaderSize:])
+}
+
+func readClientHelloSNI(conn net.Conn, reader *bufio.Reader) (string, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(clientHelloTimeout)); err != nil {
+		return "", err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	return peekClientHelloSNI(reader)
+}
+
+func parseClientHelloSNI(handshake []byte) (string, error) {
+	message := tlsBytes(handshake)
+	msgType, ok := message.readUint8()
+	if !ok || msgType != tlsClientHelloType {
+		return "", errNoClientHello
+	}
+	body, ok := message.readUint24Prefixed()
+	if !ok {
+		// ClientHellos split across records are not parsed.
+		return "", fmt.Errorf("truncated ClientHello")
+	}
+
+	if !body.skip(2 + 32) {
+		return "", fmt.Errorf("truncated ClientHello")
+	}
+	if _, ok := body.readUint8Prefixed(); !ok {
+		return "", fmt.Errorf("truncated ClientHello session ID")
+	}
+	if _, ok := body.readUint16Prefixed(); !ok {
+		return "", fmt.Errorf("truncated ClientHello cipher suites")
+	}
+	if _, ok := body.readUint8Prefixed(); !ok {
+		return "", fmt.Errorf("truncated ClientHello compression methods")
+	}
+	if len(body) == 0 {
+		return "", nil
+	}
+
+	extensions, ok := body.readUint16Prefixed()
+	if !ok {
+		return "", fmt.Errorf("truncated ClientHello extensions")
+	}
+	for len(extensions) > 0 {
+		extType, ok := extensions.readUint16()
+		if !ok {
+			return "", fmt.Errorf("truncated ClientHello extension")
+		}
+		data, ok := extensions.readUint16Prefixed()
+		if !ok {
+			return "", fmt.Errorf("truncated ClientHello extension")
+		}
+		if extType != tlsServerNameExt {
+			continue
+		}
+
+		names, ok := data.readUint16Prefixed()
+		if !ok {
+			return "", fmt.Errorf("invalid server_name extension")
+		}
+		for len(names) > 0 {
+			nameType, ok := names.readUint8()
+			if !ok {
+				return "", fmt.Errorf("invalid server_name extension")
+			}
+			name, ok := names.readUint16Prefixed()
+			if !ok {
+				return "", fmt.Errorf("invalid server_name extension")
+			}
+			if nameType == tlsServerNameHostName {
+				return string(name), nil
+			}
+		}
+		return "", nil
+	}
+	return "", nil
+}
+
+type tlsBytes []byte
+
+func (b *tlsBytes) skip(n int) bool {
+	if len(*b) < n {
+		return false
+	}
+	*b = (*b)[n:]
+	return true
+}
+
+func (b *tlsBytes) readUint8() (uint8, bool) {
+	if len(*b) < 1 {
+		return 0, false
+	}
+	value := (*b)[0]
+	*b = (*b)[1:]
+	return value, true
+}
+
+func (b *tlsBytes) readUint16() (uint16, bool) {
+	if len(*b) < 2 {
+		return 0, false
+	}
+	value := binary.BigEndian.Uint16(*b)
+	*b = (*b)[2:]
+	return value, true
+}
+
+func (b *tlsBytes) readPrefixed(size int) (tlsBytes, bool) {
+	if len(*b) < size {
+		return nil, false
+	}
+	var length int
+	for _, octet := range (*b)[:size] {
+		length = length<<8 | int(octet)
+	}
+	if len(*b) < size+length {
+		return nil, false
+	}
+	value := (*b)[size : size+length]
+	*b = (*b)[size+length:]
+	return value, true
+}
+
+func (b *tlsBytes) readUint8Prefixed() (tlsBytes, bool) {
+	return b.readPrefixed(1)
+}
+
+func (b *tlsBytes) readUint16Prefixed() (tlsBytes, bool) {
+	return b.readPrefixed(2)
+}
+
+func (b *tlsBytes) readUint24Prefixed() (tlsBytes, bool) {
+	return b.readPrefixed(3)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func captureClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	go func() {
+		defer clientConn.Close()
+		_ = tls.Client(clientConn, &tls.Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+
+	if err := serverConn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	reader := bufio.NewReaderSize(serverConn, clientHelloReaderSize)
+	header, err := reader.Peek(tlsRecordHeaderSize)
+	if err != nil {
+		t.Fatalf("read ClientHello header: %v", err)
+	}
+	size := tlsRecordHeaderSize + int(binary.BigEndian.Uint16(header[3:5]))
+	record, err := reader.Peek(size)
+	if err != nil {
+		t.Fatalf("read ClientHello: %v", err)
+	}
+	return append([]byte(nil), record...)
+}
+
+func TestPeekClientHelloSNI(t *testing.T) {
+	record := captureClientHello(t, "www.example.com")
+	reader := bufio.NewReaderSize(bytes.NewReader(record), clientHelloReaderSize)
+
+	sni, err := peekClientHelloSNI(reader)
+	if err != nil {
+		t.Fatalf("peekClientHelloSNI() error = %v", err)
+	}
+	if sni != "www.example.com" {
+		t.Fatalf("peekClientHelloSNI() = %q, want www.example.com", sni)
+	}
+	if reader.Buffered() != len(record) {
+		t.Fatalf("peekClientHelloSNI() consumed input, %d bytes buffered, want %d", reader.Buffered(), len(record))
+	}
+}
+
+func TestPeekClientHelloSNIWithoutServerName(t *testing.T) {
+	// crypto/tls omits SNI for IP addresses.
+	record := captureClientHello(t, "127.0.0.1")
+
+	sni, err := peekClientHelloSNI(bufio.NewReaderSize(bytes.NewReader(record), clientHelloReaderSize))
+	if err != nil {
+		t.Fatalf("peekClientHelloSNI() error = %v", err)
+	}
+	if sni != "" {
+		t.Fatalf("peekClientHelloSNI() = %q, want empty", sni)
+	}
+}
+
+func TestPeekClientHelloSNIErrors(t *testing.T) {
+	record := captureClientHello(t, "www.example.com")
+	truncated := append([]byte(nil), record[:60]...)
+	truncated[3], truncated[4] = 0, 55
+
+	tests := map[string][]byte{
+		"plain HTTP":      []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		"short record":    record[:len(record)-1],
+		"not ClientHello": {tlsHandshakeRecord, 0x03, 0x01, 0x00, 0x04, 0x02, 0x00, 0x00, 0x00},
+		"truncated hello": truncated,
+	}
+	for name, input := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := peekClientHelloSNI(bufio.NewReaderSize(bytes.NewReader(input), clientHelloReaderSize)); err == nil {
+				t.Fatal("peekClientHelloSNI() error = nil, want error")
+			}
+		})
+	}
+}
@@ -1,21 +1,66 @@
 package main
 
 import (
-	"crypto/ecdsa"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"time"
 )
 
 type RunningConfig struct {
-	Debug             bool
-	Addr              string
-	Port              string
-	TLSVersion        string
-	TLSClient         string
-	FingerprintConfig string
-	Cert              string
-	Key               string
-	Upstream          string
+	Debug              bool
+	Addr               string
+	Port               string
+	Listeners          string
+	ProxyTLSCert       string
+	ProxyTLSKey        string
+	ProxyTLSPlaintext  bool
+	ProxyProtocolFrom  string
+	Transparent        string
+	TProxy             bool
+	SNIListen          string
+	SNIRoutes          string
+	SNIResolver        string
+	SNIUnmatched       string
+	TLSVersion         string
+	TLSClient          string
+	FingerprintConfig  string
+	Cert               string
+	Key                string
+	KeyPassphrase      string
+	CASigner           string
+	EphemeralCA        bool
+	EphemeralCAExport  string
+	CertOverrides      string
+	Upstream           string
+	UpstreamCA         string
+	UpstreamInsecure   bool
+	UpstreamCert       string
+	UpstreamKey        string
+	UpstreamTLSClient  string
+	UpstreamTLSVersion string
+	UpstreamStrategy   string
+	UpstreamHealth     time.Duration
+	UpstreamHealthAddr string
+	UpstreamMaxFails   int
+	UpstreamEjectTime  time.Duration
+	UpstreamFailClosed bool
+	AuthFile           string
+	UpstreamAuth       string
+	UpstreamAuthMap    string
+	Sessions           bool
+	SessionIdle        time.Duration
+	SessionUser        string
+	SessionPassword    string
+	SessionFingerprint string
+	TunnelHTTP         bool
+	TLSUpgradeHosts    string
+	Via                string
+	XForwardedFor      bool
+	SOCKS5BindPorts    string
+	SOCKS5BindTimeout  time.Duration
+	LeafKeyMode        string
+	LeafKeyRotation    time.Duration
 }
 
 type CertificateAuthority struct {
@@ -24,6 +69,6 @@ type CertificateAuthority struct {
 }
 
 type SessionKeyHelper struct {
-	privateKey *ecdsa.PrivateKey
+	privateKey crypto.Signer
 	PEMBlock   []byte
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -14,45 +15,99 @@ import (
 type UpstreamDialer struct {
 	dialer    proxy.Dialer
 	Transport http.RoundTripper
+	proxyURL  *url.URL
+	proxyTLS  *UpstreamTLS
+	timeout   time.Duration
 }
 
 func NewUpstreamDialer(socksAddr string, timeout time.Duration) (*UpstreamDialer, error) {
-	var dialer proxy.Dialer
-	var transport http.RoundTripper = http.DefaultTransport
+	return NewUpstreamDialerWithTLS(socksAddr, timeout, nil)
+}
 
-	if socksAddr != "" {
-		parsedURL, err := parseSocksURL(socksAddr)
-		if err != nil {
-			return nil, err
-		}
-		user := parsedURL.User.Username()
-		password, _ := parsedURL.User.Password()
-		socksDialer, err := proxy.SOCKS5(
-			"tcp", parsedURL.Host,
-			&proxy.Auth{User: user, Password: password},
-			proxy.Direct,
-		)
-		if err != nil {
-			return nil, err
-		}
-		dialer = socksDialer
+func NewUpstreamDialerWithTLS(socksAddr string, timeout time.Duration, proxyTLS *UpstreamTLS) (*UpstreamDialer, error) {
+	if socksAddr == "" {
+		return &UpstreamDialer{
+			dialer:    &net.Dialer{Timeout: timeout},
+			Transport: http.DefaultTransport,
+			timeout:   timeout,
+		}, nil
+	}
 
+	parsedURL, err := parseUpstreamURL(socksAddr)
+	if err != nil {
+		return nil, err
+	}
+	upstream := &UpstreamDialer{
+		proxyURL: parsedURL,
+		proxyTLS: proxyTLS,
+		timeout:  timeout,
+	}
+	if upstream.dialer, err = upstream.proxyDialer(nil); err != nil {
+		return nil, err
+	}
+
+	switch parsedURL.Scheme {
+	case "http", "https":
+		upstream.Transport = upstream.dialer.(*httpConnectDialer).transport()
+	default:
 		defaultTransport := http.DefaultTransport.(*http.Transport).Clone()
 		defaultTransport.Proxy = func(req *http.Request) (*url.URL, error) {
-			return parsedURL, nil
+			return withUpstreamUser(parsedURL, upstreamAuthFrom(req.Context())), nil
 		}
-		transport = defaultTransport
-	} else {
-		dialer = &net.Dialer{Timeout: timeout}
+		upstream.Transport = defaultTransport
 	}
+	return upstream, nil
+}
+
+// proxyDialer dials through the upstream proxy, authenticating as user
+// instead of the URL credentials when user is set.
+func (u *UpstreamDialer) proxyDialer(user *url.Userinfo) (proxy.Dialer, error) {
+	proxyURL := withUpstreamUser(u.proxyURL, user)
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return &httpConnectDialer{
+			proxyURL: proxyURL,
+			proxyTLS: u.proxyTLS,
+			timeout:  u.timeout,
+		}, nil
+	}
+
+	password, _ := proxyURL.User.Password()
+	return proxy.SOCKS5(
+		"tcp", proxyURL.Host,
+		&proxy.Auth{User: proxyURL.User.Username(), Password: password},
+		&upstreamForwardDialer{proxy: proxyURL.Host, timeout: u.timeout},
+	)
+}
+
+type upstreamAuthKey struct{}
+
+// withUpstreamAuth makes dials with ctx authenticate to the upstream proxy as
+// user. A user without a password keeps the password from the upstream URL.
+func withUpstreamAuth(ctx context.Context, user *url.Userinfo) context.Context {
+	return context.WithValue(ctx, upstreamAuthKey{}, user)
+}
+
+func upstreamAuthFrom(ctx context.Context) *url.Userinfo {
+	user, _ := ctx.Value(upstreamAuthKey{}).(*url.Userinfo)
+	return user
+}
 
-	return &UpstreamDialer{
-		dialer:    dialer,
-		Transport: transport,
-	}, nil
+func withUpstreamUser(proxyURL *url.URL, user *url.Userinfo) *url.URL {
+	if user == nil {
+		return proxyURL
+	}
+	if _, ok := user.Password(); !ok {
+		if password, ok := proxyURL.User.Password(); ok {
+			user = url.UserPassword(user.Username(), password)
+		}
+	}
+	withUser := *proxyURL
+	withUser.User = user
+	return &withUser
 }
 
-func parseSocksURL(socksAddr string) (*url.URL, error) {
+func parseUpstreamURL(socksAddr string) (*url.URL, error) {
 	parsedURL, err := url.Parse(socksAddr)
 	if err != nil || !strings.Contains(socksAddr, "://") {
 		parsedURL, err = url.Parse("socks5://" + socksAddr)
@@ -63,7 +118,9 @@ func parseSocksURL(socksAddr string) (*url.URL, error) {
 	if parsedURL.Scheme == "" {
 		parsedURL.Scheme = "socks5"
 	}
-	if parsedURL.Scheme != "socks5" {
+	switch parsedURL.Scheme {
+	case "socks5", "http", "https":
+	default:
 		return nil, fmt.Errorf("unsupported upstream proxy scheme %q", parsedURL.Scheme)
 	}
 	if parsedURL.Host == "" {
@@ -75,3 +132,47 @@ func parseSocksURL(socksAddr string) (*url.URL, error) {
 func (u *UpstreamDialer) Dial(network, addr string) (net.Conn, error) {
 	return u.dialer.Dial(network, addr)
 }
+
+func (u *UpstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := u.dialer
+	if user := upstreamAuthFrom(ctx); user != nil && u.proxyURL != nil {
+		var err error
+		if dialer, err = u.proxyDialer(user); err != nil {
+			return nil, err
+		}
+	}
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, network, addr)
+	}
+	return dialer.Dial(network, addr)
+}
+
+// upstreamForwardDialer connects to a SOCKS5 upstream and marks failures as
+// the proxy being unreachable.
+type upstreamForwardDialer struct {
+	proxy   string
+	timeout time.Duration
+}
+
+func (d *upstreamForwardDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *upstreamForwardDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.timeout}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, upstreamUnreachable(d.proxy, err)
+	}
+	return conn, nil
+}
+
+func (u *UpstreamDialer) ListenUDP(ctx context.Context) (udpEgress, error) {
+	if u.proxyURL != nil {
+		if u.proxyURL.Scheme != "socks5" {
+			return nil, fmt.Errorf("UDP relay needs a SOCKS5 upstream, not %s", u.proxyURL.Scheme)
+		}
+		return newSOCKS5UDPEgress(withUpstreamUser(u.proxyURL, upstreamAuthFrom(ctx)), u.timeout)
+	}
+	return newDirectUDPEgress()
+}
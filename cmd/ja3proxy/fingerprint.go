@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -153,3 +154,52 @@ func (s *TLSFingerprintStore) WatchFile(ctx context.Context, path string, interv
 
 	return nil
 }
+
+// watchFiles runs apply, then runs it again whenever one of the files listed
+// by paths changes, until ctx is done. Failed reloads keep the previous state.
+func watchFiles(ctx context.Context, interval time.Duration, name string, paths func() []string, apply func() error) error {
+	if interval <= 0 {
+		return fmt.Errorf("%s reload interval must be positive", name)
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	lastSignature := filesSignature(paths())
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if filesSignature(paths()) == lastSignature {
+					continue
+				}
+
+				if err := apply(); err != nil {
+					log.Printf("reload %s: %v", name, err)
+					continue
+				}
+				lastSignature = filesSignature(paths())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func filesSignature(paths []string) string {
+	var signature strings.Builder
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(&signature, "%s:missing;", path)
+			continue
+		}
+		fmt.Fprintf(&signature, "%s:%d:%d;", path, stat.ModTime().UnixNano(), stat.Size())
+	}
+	return signature.String()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func viaProtocol(major, minor int) string {
+	if major == 0 {
+		return "1.1"
+	}
+	return fmt.Sprintf("%d.%d", major, minor)
+}
+
+func (p *Proxy) viaLoop(header http.Header) bool {
+	if p == nil || p.via == "" {
+		return false
+	}
+	for _, value := range header.Values("Via") {
+		for _, hop := range strings.Split(value, ",") {
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], p.via) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Proxy) prepareForwardRequest(outReq *http.Request, req *http.Request) {
+	keepTrailers := headerContainsToken(req.Header, "Te", "trailers")
+	removeHopByHopHeaders(outReq.Header)
+	if keepTrailers {
+		outReq.Header.Set("Te", "trailers")
+	}
+	if p == nil {
+		return
+	}
+
+	if p.forwardedFor {
+		if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			if prior := outReq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+				clientIP = strings.Join(prior, ", ") + ", " + clientIP
+			}
+			outReq.Header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	p.addVia(outReq.Header, req.ProtoMajor, req.ProtoMinor)
+}
+
+func (p *Proxy) addVia(header http.Header, major, minor int) {
+	if p != nil && p.via != "" {
+		header.Add("Via", viaProtocol(major, minor)+" "+p.via)
+	}
+}
+
+func (p *Proxy) writeForwardResponse(w http.ResponseWriter, resp *http.Response) {
+	removeHopByHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+	p.addVia(w.Header(), resp.ProtoMajor, resp.ProtoMinor)
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	if err := copyResponseBody(w, resp); err != nil {
+		log.Printf("copy response body: %v", err)
+		return
+	}
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+name, value)
+		}
+	}
+}
+
+func streamingResponse(resp *http.Response) bool {
+	if resp.ContentLength == -1 {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+func copyResponseBody(w http.ResponseWriter, resp *http.Response) error {
+	if !streamingResponse(resp) {
+		_, err := io.Copy(w, resp.Body)
+		return err
+	}
+
+	controller := http.NewResponseController(w)
+	flush := func() error {
+		if err := controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		return nil
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flushErr := flush(); flushErr != nil {
+				return flushErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
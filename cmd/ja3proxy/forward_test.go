@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleHTTPStripsHopByHopHeaders(t *testing.T) {
+	var upstreamReq *http.Request
+	proxy := NewProxy(nil, nil, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		upstreamReq = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"Connection":     {"X-Upstream-Hop"},
+				"Keep-Alive":     {"timeout=5"},
+				"X-Upstream-Hop": {"1"},
+				"X-Test":         {"ok"},
+			},
+			Body: io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Connection", "keep-alive, X-Client-Hop")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6c2VjcmV0")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("X-Keep", "yes")
+	rec := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rec, req)
+
+	for _, name := range []string{"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authorization", "Upgrade", "X-Client-Hop"} {
+		if got := upstreamReq.Header.Get(name); got != "" {
+			t.Fatalf("forwarded %s = %q, want stripped", name, got)
+		}
+	}
+	if got := upstreamReq.Header.Get("Te"); got != "trailers" {
+		t.Fatalf("forwarded Te = %q, want trailers", got)
+	}
+	if got := upstreamReq.Header.Get("X-Keep"); got != "yes" {
+		t.Fatalf("forwarded X-Keep = %q, want yes", got)
+	}
+
+	resp := rec.Result()
+	for _, name := range []string{"Keep-Alive", "X-Upstream-Hop"} {
+		if got := resp.Header.Get(name); got != "" {
+			t.Fatalf("response %s = %q, want stripped", name, got)
+		}
+	}
+	if got := resp.Header.Get("X-Test"); got != "ok" {
+		t.Fatalf("response X-Test = %q, want ok", got)
+	}
+}
+
+func TestHandleHTTPAddsForwardingHeaders(t *testing.T) {
+	var upstreamReq *http.Request
+	proxy := NewProxy(nil, nil, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		upstreamReq = req
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			ProtoMajor: 1,
+			ProtoMinor: 0,
+			Header:     http.Header{"Via": {"1.1 origin-cache"}},
+			Body:       io.NopCloser(strings.NewReader("ok")),
+		}, nil
+	}))
+	proxy.via = "ja3proxy"
+	proxy.forwardedFor = true
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("Via", "1.0 edge")
+	rec := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rec, req)
+
+	if got := upstreamReq.Header.Get("X-Forwarded-For"); got != "198.51.100.1, 192.0.2.10" {
+		t.Fatalf("X-Forwarded-For = %q, want appended client address", got)
+	}
+	if got := upstreamReq.Header.Values("Via"); len(got) != 2 || got[1] != "1.1 ja3proxy" {
+		t.Fatalf("request Via = %q, want 1.1 ja3proxy appended", got)
+	}
+	if got := rec.Result().Header.Values("Via"); len(got) != 2 || got[1] != "1.0 ja3proxy" {
+		t.Fatalf("response Via = %q, want 1.0 ja3proxy appended", got)
+	}
+}
+
+func TestHandleHTTPDetectsViaLoop(t *testing.T) {
+	proxy := NewProxy(nil, nil, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Error("looping request should not be forwarded")
+		return nil, io.EOF
+	}))
+	proxy.via = "ja3proxy"
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Via", "1.1 edge, 1.1 JA3Proxy")
+	rec := httptest.NewRecorder()
+
+	proxy.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusLoopDetected {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusLoopDetected)
+	}
+}
+
+func TestHandleHTTPPropagatesTrailers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc123")
+	}))
+	t.Cleanup(upstream.Close)
+
+	proxyServer := httptest.NewServer(NewProxy(nil, nil, nil))
+	t.Cleanup(proxyServer.Close)
+
+	client := newProxyHTTPClient(t, proxyServer.URL, nil)
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("proxy request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if string(body) != "body" {
+		t.Fatalf("body = %q, want body", body)
+	}
+	if got := resp.Trailer.Get("X-Checksum"); got != "abc123" {
+		t.Fatalf("trailer X-Checksum = %q, want abc123", got)
+	}
+}
+
+func TestHandleHTTPFlushesStreamedResponses(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	}))
+	t.Cleanup(upstream.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	proxyServer := httptest.NewServer(NewProxy(nil, nil, nil))
+	t.Cleanup(proxyServer.Close)
+
+	client := newProxyHTTPClient(t, proxyServer.URL, nil)
+	resp, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatalf("proxy request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		lines <- line
+	}()
+	select {
+	case line := <-lines:
+		if line != "data: first\n" {
+			t.Fatalf("first event = %q, want data: first", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("streamed event was not flushed before the response finished")
+	}
+	close(release)
+}
+
+func TestRemoveHopByHopHeadersHonoursConnectionTokens(t *testing.T) {
+	header := http.Header{
+		"Connection": {"close, X-Foo", "x-bar"},
+		"X-Foo":      {"1"},
+		"X-Bar":      {"2"},
+		"X-Baz":      {"3"},
+	}
+	removeHopByHopHeaders(header)
+	if len(header) != 1 || header.Get("X-Baz") != "3" {
+		t.Fatalf("headers = %v, want only X-Baz", header)
+	}
+}
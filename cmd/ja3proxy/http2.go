@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+)
+
+const http2ClientPreface = http2.ClientPreface
+
+// peekHTTP2Preface compares the connection preface one byte at a time, so a
+// short HTTP/1 request that starts with "P" is not left waiting for more data.
+func peekHTTP2Preface(reader *bufio.Reader) bool {
+	for i := 1; i <= len(http2ClientPreface); i++ {
+		peeked, err := reader.Peek(i)
+		if err != nil || peeked[i-1] != http2ClientPreface[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+func (listener *mixedProxyListener) serveHTTP2(conn net.Conn) {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-listener.done:
+			conn.Close()
+		case <-finished:
+		}
+	}()
+
+	listener.http2Server.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: listener.proxy,
+	})
+}
+
+type http2StreamConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *http2StreamConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// pipeHTTP2Stream exposes an HTTP/2 request and response body pair as a
+// net.Conn. It is backed by net.Pipe so deadlines work without resetting the
+// stream. The returned function closes the conn and waits until nothing else
+// writes to w.
+func pipeHTTP2Stream(w http.ResponseWriter, r *http.Request) (net.Conn, func()) {
+	streamConn, proxySide := net.Pipe()
+	controller := http.NewResponseController(w)
+
+	go func() {
+		if _, err := io.Copy(proxySide, r.Body); err != nil {
+			proxySide.Close()
+		}
+	}()
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := proxySide.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					proxySide.Close()
+					return
+				}
+				if err := controller.Flush(); err != nil {
+					proxySide.Close()
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var remoteAddr net.Addr = streamConn.RemoteAddr()
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remoteAddr = addr
+	}
+	return &http2StreamConn{
+		Conn:       streamConn,
+		remoteAddr: remoteAddr,
+	}, func() {
+		streamConn.Close()
+		<-written
+	}
+}
+
+func (p *Proxy) handleHTTP2Tunneling(w http.ResponseWriter, r *http.Request) {
+	if protocol := r.Header.Get(":protocol"); protocol != "" {
+		p.handleExtendedConnect(w, r, protocol)
+		return
+	}
+
+	destConn, err := p.dialFor(r.Context(), r.RemoteAddr, "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), dialErrorStatus(err))
+		log.Println("Tunneling err: ", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		destConn.Close()
+		log.Println("CONNECT response flush error: ", err)
+		return
+	}
+
+	clientConn, closeStream := pipeHTTP2Stream(w, r)
+	defer closeStream()
+	p.tunnel(r.Host, destConn, clientConn, bufio.NewReader(clientConn))
+}
+
+// handleExtendedConnect turns an RFC 8441 CONNECT with :protocol into an
+// HTTP/1.1 upgrade to the target. HTTP/2 does not carry :scheme on to the
+// handler, so targets on port 443 are reached over TLS.
+func (p *Proxy) handleExtendedConnect(w http.ResponseWriter, r *http.Request, protocol string) {
+	log.Printf("extended CONNECT %s to %s", protocol, r.Host)
+
+	outReq := r.Clone(r.Context())
+	outReq.Method = http.MethodGet
+	outReq.RequestURI = ""
+	outReq.Body = http.NoBody
+	outReq.ContentLength = 0
+	outReq.URL.Scheme = "http"
+	if _, port, err := net.SplitHostPort(r.Host); err == nil && port == "443" {
+		outReq.URL.Scheme = "https"
+	}
+	outReq.URL.Host = r.Host
+	outReq.Header.Del(":protocol")
+	p.prepareForwardRequest(outReq, r)
+	if strings.EqualFold(protocol, "websocket") && outReq.Header.Get("Sec-Websocket-Key") == "" {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		outReq.Header.Set("Sec-Websocket-Key", base64.StdEncoding.EncodeToString(key))
+	}
+
+	destConn, resp, ok := p.upgradeUpstream(w, outReq, protocol)
+	if !ok {
+		return
+	}
+	resp.Header.Del("Sec-Websocket-Accept")
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(http.StatusOK)
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		destConn.Close()
+		log.Println("extended CONNECT response flush error: ", err)
+		return
+	}
+
+	clientConn, closeStream := pipeHTTP2Stream(w, r)
+	defer closeStream()
+	p.pipeUpgrade(destConn, clientConn, protocol)
+}
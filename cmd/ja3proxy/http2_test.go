@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func newHTTP2ProxyServer(t *testing.T, proxy *Proxy, tlsConfig *tls.Config) string {
+	t.Helper()
+
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &http.Server{
+		Handler: proxy,
+	}
+	go func() {
+		_ = server.Serve(newMixedProxyListener(baseListener, proxy, mixedListenerOptions{TLSConfig: tlsConfig}))
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return baseListener.Addr().String()
+}
+
+func newH2CTransport(t *testing.T, proxyAddr string) *http2.Transport {
+	t.Helper()
+
+	transport := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, proxyAddr)
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+	return transport
+}
+
+func newTCPEchoServer(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHTTP2ConnectStreamsAreMultiplexed(t *testing.T) {
+	echoAddr := newTCPEchoServer(t)
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, echoAddr, 2*time.Second)
+	}, func(sni string, destConn net.Conn, clientConn net.Conn) {
+		t.Error("non-TLS CONNECT stream should not use TLS MITM connect")
+	}, nil)
+	transport := newH2CTransport(t, newHTTP2ProxyServer(t, proxy, nil))
+
+	var wg sync.WaitGroup
+	for i := range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reqBody, bodyWriter := io.Pipe()
+			defer bodyWriter.Close()
+			target := fmt.Sprintf("echo-%d.test:7", i)
+			req := &http.Request{
+				Method: http.MethodConnect,
+				URL:    &url.URL{Scheme: "http", Host: target},
+				Host:   target,
+				Header: http.Header{},
+				Body:   reqBody,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := transport.RoundTrip(req.WithContext(ctx))
+			if err != nil {
+				t.Errorf("CONNECT %s: %v", target, err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("CONNECT %s status = %d, want 200", target, resp.StatusCode)
+				return
+			}
+
+			message := "hello from " + target + "\n"
+			if _, err := io.WriteString(bodyWriter, message); err != nil {
+				t.Errorf("write stream %s: %v", target, err)
+				return
+			}
+			got, err := bufio.NewReader(resp.Body).ReadString('\n')
+			if err != nil {
+				t.Errorf("read stream %s: %v", target, err)
+				return
+			}
+			if got != message {
+				t.Errorf("stream %s echoed %q, want %q", target, got, message)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestHTTP2OverTLSForwardsPlainRequests(t *testing.T) {
+	proxy := NewProxy(nil, nil, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "http://example.com/resource" {
+			t.Errorf("upstream URL = %q, want http://example.com/resource", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("h2 proxy")),
+		}, nil
+	}))
+	proxyAddr := newHTTP2ProxyServer(t, proxy, &tls.Config{
+		Certificates: []tls.Certificate{localTLSCertificate(t)},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+
+	var negotiated string
+	transport := &http2.Transport{
+		DialTLSContext: func(ctx context.Context, network, _ string, _ *tls.Config) (net.Conn, error) {
+			dialer := &tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}}}
+			conn, err := dialer.DialContext(ctx, network, proxyAddr)
+			if err == nil {
+				negotiated = conn.(*tls.Conn).ConnectionState().NegotiatedProtocol
+			}
+			return conn, err
+		},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	req, err := http.NewRequest(http.MethodGet, "https://example.com/resource", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("h2 request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "h2 proxy" {
+		t.Fatalf("response = %d %q, want 200 h2 proxy", resp.StatusCode, body)
+	}
+	if negotiated != "h2" {
+		t.Fatalf("negotiated protocol = %q, want h2", negotiated)
+	}
+}
+
+func TestHTTP2ExtendedConnectUpgradesWebsocket(t *testing.T) {
+	// x/net/http2 reads GODEBUG once at init, so rerun the test in a process
+	// that starts with extended CONNECT enabled.
+	if godebug := os.Getenv("GODEBUG"); !strings.Contains(godebug, "http2xconnect=1") {
+		if godebug != "" {
+			godebug += ","
+		}
+		cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "GODEBUG="+godebug+"http2xconnect=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("extended CONNECT test process: %v\n%s", err, out)
+		}
+		return
+	}
+
+	upstream := newWebsocketEchoServer(t)
+	upstreamAddr := strings.TrimPrefix(upstream.URL, "http://")
+
+	dialed := make(chan string, 1)
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return net.DialTimeout(network, upstreamAddr, 2*time.Second)
+	}, nil, nil)
+	transport := newH2CTransport(t, newHTTP2ProxyServer(t, proxy, nil))
+
+	reqBody, bodyWriter := io.Pipe()
+	defer bodyWriter.Close()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "http", Host: "ws.example.com:80", Path: "/chat"},
+		Host:   "ws.example.com:80",
+		Header: http.Header{
+			":protocol":             {"websocket"},
+			"Sec-Websocket-Version": {"13"},
+		},
+		Body: reqBody,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := transport.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("extended CONNECT: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("extended CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	if got := <-dialed; got != "ws.example.com:80" {
+		t.Fatalf("dialed %q, want ws.example.com:80", got)
+	}
+	if got := resp.Header.Get("Sec-Websocket-Accept"); got != "" {
+		t.Fatalf("Sec-Websocket-Accept = %q, want removed for HTTP/2", got)
+	}
+
+	if _, err := io.WriteString(bodyWriter, "\x81\x02hi"); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, got); err != nil {
+		t.Fatalf("read echoed frame: %v", err)
+	}
+	if string(got) != "\x81\x02hi" {
+		t.Fatalf("echoed frame = %q, want text frame", got)
+	}
+}
+
+func TestPeekHTTP2Preface(t *testing.T) {
+	tests := map[string]bool{
+		http2ClientPreface:                  true,
+		"PUT / HTTP/1.0\r\n\r\n":            false,
+		"POST /upload HTTP/1.1\r\n\r\n":     false,
+		"PRI * HTTP/1.1\r\nHost: x\r\n\r\n": false,
+	}
+	for input, want := range tests {
+		if got := peekHTTP2Preface(bufio.NewReader(strings.NewReader(input))); got != want {
+			t.Fatalf("peekHTTP2Preface(%q) = %t, want %t", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/list"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const leafRSAKeyBits = 2048
+
+type LeafKeyType string
+
+const (
+	LeafKeyECDSA LeafKeyType = "ecdsa"
+	LeafKeyRSA   LeafKeyType = "rsa"
+)
+
+type LeafKeyMode string
+
+const (
+	LeafKeyShared  LeafKeyMode = "shared"
+	LeafKeyPerHost LeafKeyMode = "per-host"
+)
+
+func parseLeafKeyMode(mode string) (LeafKeyMode, error) {
+	switch LeafKeyMode(mode) {
+	case "", LeafKeyShared:
+		return LeafKeyShared, nil
+	case LeafKeyPerHost:
+		return LeafKeyPerHost, nil
+	default:
+		return "", fmt.Errorf("unsupported leaf key mode %q", mode)
+	}
+}
+
+type leafKeyID struct {
+	host    string
+	keyType LeafKeyType
+}
+
+// maxLeafKeys bounds the per-host key cache; the least recently used keys are
+// dropped first.
+const maxLeafKeys = 4096
+
+// leafKeyEntry is ready once its key has been generated, so concurrent
+// handshakes for the same key wait for one generation.
+type leafKeyEntry struct {
+	id      leafKeyID
+	session SessionKeyHelper
+	err     error
+	created time.Time
+	ready   chan struct{}
+}
+
+type LeafKeyStore struct {
+	Mode     LeafKeyMode
+	Rotation time.Duration
+
+	mu      sync.Mutex
+	keys    map[leafKeyID]*list.Element
+	lru     *list.List
+	maxKeys int
+	now     func() time.Time
+}
+
+func NewLeafKeyStore(mode LeafKeyMode, rotation time.Duration) *LeafKeyStore {
+	store := &LeafKeyStore{
+		Mode:     mode,
+		Rotation: rotation,
+	}
+	store.init()
+	return store
+}
+
+func (s *LeafKeyStore) Seed(session *SessionKeyHelper, keyType LeafKeyType) {
+	if session == nil || session.privateKey == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.init()
+	entry := &leafKeyEntry{
+		id:      leafKeyID{keyType: keyType},
+		session: *session,
+		created: s.now(),
+		ready:   make(chan struct{}),
+	}
+	close(entry.ready)
+	if elem, ok := s.keys[entry.id]; ok {
+		s.remove(elem)
+	}
+	s.insert(entry)
+}
+
+func (s *LeafKeyStore) Get(host string, keyType LeafKeyType) (SessionKeyHelper, error) {
+	id := leafKeyID{keyType: keyType}
+	if s.Mode == LeafKeyPerHost {
+		id.host = stripPort(host)
+	}
+
+	s.mu.Lock()
+	s.init()
+	entry, ok := s.lookup(id, s.now())
+	if !ok {
+		entry = &leafKeyEntry{id: id, created: s.now(), ready: make(chan struct{})}
+		s.insert(entry)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		<-entry.ready
+		return entry.session, entry.err
+	}
+
+	// Key generation, RSA in particular, runs outside the lock so handshakes
+	// for other keys do not queue behind it.
+	entry.err = entry.session.GenerateType(keyType)
+	close(entry.ready)
+	if entry.err != nil {
+		s.mu.Lock()
+		if elem, ok := s.keys[id]; ok && elem.Value == entry {
+			s.remove(elem)
+		}
+		s.mu.Unlock()
+		return SessionKeyHelper{}, entry.err
+	}
+	return entry.session, nil
+}
+
+func (s *LeafKeyStore) init() {
+	if s.keys == nil {
+		s.keys = make(map[leafKeyID]*list.Element)
+		s.lru = list.New()
+	}
+	if s.maxKeys <= 0 {
+		s.maxKeys = maxLeafKeys
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+}
+
+// lookup returns the cached entry for id unless it is due for rotation.
+func (s *LeafKeyStore) lookup(id leafKeyID, now time.Time) (*leafKeyEntry, bool) {
+	elem, ok := s.keys[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*leafKeyEntry)
+	if s.Rotation > 0 && now.Sub(entry.created) >= s.Rotation {
+		s.remove(elem)
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (s *LeafKeyStore) insert(entry *leafKeyEntry) {
+	s.keys[entry.id] = s.lru.PushFront(entry)
+	for s.lru.Len() > s.maxKeys {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *LeafKeyStore) remove(elem *list.Element) {
+	s.lru.Remove(elem)
+	delete(s.keys, elem.Value.(*leafKeyEntry).id)
+}
+
+var ecdsaCipherSuites = map[uint16]bool{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:          true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:          true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256:       true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:       true,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:       true,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256: true,
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:              true,
+}
+
+func leafKeyTypeForClient(hello *tls.ClientHelloInfo) LeafKeyType {
+	if hello == nil {
+		return LeafKeyECDSA
+	}
+
+	supportsScheme := false
+	for _, scheme := range hello.SignatureSchemes {
+		if scheme == tls.ECDSAWithP256AndSHA256 {
+			supportsScheme = true
+			break
+		}
+	}
+	if !supportsScheme {
+		return LeafKeyRSA
+	}
+
+	for _, version := range hello.SupportedVersions {
+		if version >= tls.VersionTLS13 {
+			return LeafKeyECDSA
+		}
+	}
+	for _, suite := range hello.CipherSuites {
+		if ecdsaCipherSuites[suite] {
+			return LeafKeyECDSA
+		}
+	}
+	return LeafKeyRSA
+}
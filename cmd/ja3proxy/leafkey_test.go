@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLeafKeyMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    LeafKeyMode
+		wantErr bool
+	}{
+		{in: "", want: LeafKeyShared},
+		{in: "shared", want: LeafKeyShared},
+		{in: "per-host", want: LeafKeyPerHost},
+		{in: "per-request", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLeafKeyMode(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("parseLeafKeyMode(%q) error = nil, want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parseLeafKeyMode(%q) error = %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("parseLeafKeyMode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLeafKeyStoreSharedReusesSeededKey(t *testing.T) {
+	seed := &SessionKeyHelper{}
+	if err := seed.Generate(); err != nil {
+		t.Fatalf("SessionKeyHelper.Generate() error = %v", err)
+	}
+	store := NewLeafKeyStore(LeafKeyShared, 0)
+	store.Seed(seed, LeafKeyECDSA)
+
+	first, err := store.Get("a.example:443", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	second, err := store.Get("b.example:443", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(first.PEMBlock, seed.PEMBlock) || !bytes.Equal(second.PEMBlock, seed.PEMBlock) {
+		t.Fatal("shared mode did not reuse the seeded key")
+	}
+
+	rsaKey, err := store.Get("a.example:443", LeafKeyRSA)
+	if err != nil {
+		t.Fatalf("Get(rsa) error = %v", err)
+	}
+	if _, ok := rsaKey.privateKey.(*rsa.PrivateKey); !ok {
+		t.Fatalf("rsa leaf key = %T, want *rsa.PrivateKey", rsaKey.privateKey)
+	}
+}
+
+func TestLeafKeyStorePerHostUsesDistinctKeys(t *testing.T) {
+	store := NewLeafKeyStore(LeafKeyPerHost, 0)
+
+	first, err := store.Get("a.example:443", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	again, err := store.Get("a.example", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	other, err := store.Get("b.example:443", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+
+	if !bytes.Equal(first.PEMBlock, again.PEMBlock) {
+		t.Fatal("per-host mode generated a new key for the same host")
+	}
+	if bytes.Equal(first.PEMBlock, other.PEMBlock) {
+		t.Fatal("per-host mode reused a key across hosts")
+	}
+}
+
+func TestLeafKeyStoreRotatesExpiredKeys(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := NewLeafKeyStore(LeafKeyShared, time.Minute)
+	store.now = func() time.Time { return now }
+
+	first, err := store.Get("a.example", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	now = now.Add(30 * time.Second)
+	second, err := store.Get("a.example", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(first.PEMBlock, second.PEMBlock) {
+		t.Fatal("key rotated before the rotation interval")
+	}
+
+	now = now.Add(time.Minute)
+	third, err := store.Get("a.example", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if bytes.Equal(first.PEMBlock, third.PEMBlock) {
+		t.Fatal("key was not rotated after the rotation interval")
+	}
+}
+
+func TestLeafKeyStorePerHostEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewLeafKeyStore(LeafKeyPerHost, 0)
+	store.maxKeys = 2
+
+	first, err := store.Get("a.example", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	for _, host := range []string{"b.example", "a.example", "c.example"} {
+		if _, err := store.Get(host, LeafKeyECDSA); err != nil {
+			t.Fatalf("Get(%s) error = %v", host, err)
+		}
+	}
+	if got := len(store.keys); got != 2 {
+		t.Fatalf("store holds %d keys, want 2", got)
+	}
+	again, err := store.Get("a.example", LeafKeyECDSA)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !bytes.Equal(first.PEMBlock, again.PEMBlock) {
+		t.Fatal("recently used key was evicted")
+	}
+	if _, ok := store.keys[leafKeyID{host: "b.example", keyType: LeafKeyECDSA}]; ok {
+		t.Fatal("least recently used key was not evicted")
+	}
+}
+
+func TestLeafKeyStoreGeneratesConcurrentRequestsOnce(t *testing.T) {
+	store := NewLeafKeyStore(LeafKeyPerHost, 0)
+
+	var wg sync.WaitGroup
+	keys := make([]SessionKeyHelper, 8)
+	for i := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := store.Get("a.example", LeafKeyRSA)
+			if err != nil {
+				t.Errorf("Get() error = %v", err)
+			}
+			keys[i] = key
+		}()
+	}
+	wg.Wait()
+	for _, key := range keys[1:] {
+		if !bytes.Equal(key.PEMBlock, keys[0].PEMBlock) {
+			t.Fatal("concurrent requests generated different keys")
+		}
+	}
+}
+
+func TestLeafKeyTypeForClient(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello *tls.ClientHelloInfo
+		want  LeafKeyType
+	}{
+		{name: "nil hello", hello: nil, want: LeafKeyECDSA},
+		{
+			name: "tls13 with ecdsa",
+			hello: &tls.ClientHelloInfo{
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+				SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12},
+			},
+			want: LeafKeyECDSA,
+		},
+		{
+			name: "tls12 with ecdsa cipher",
+			hello: &tls.ClientHelloInfo{
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				SupportedVersions: []uint16{tls.VersionTLS12},
+				CipherSuites:      []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			},
+			want: LeafKeyECDSA,
+		},
+		{
+			name: "tls12 with rsa ciphers only",
+			hello: &tls.ClientHelloInfo{
+				SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PKCS1WithSHA256},
+				SupportedVersions: []uint16{tls.VersionTLS12},
+				CipherSuites:      []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			},
+			want: LeafKeyRSA,
+		},
+		{
+			name: "rsa signatures only",
+			hello: &tls.ClientHelloInfo{
+				SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+				SupportedVersions: []uint16{tls.VersionTLS13},
+			},
+			want: LeafKeyRSA,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leafKeyTypeForClient(tt.hello); got != tt.want {
+				t.Fatalf("leafKeyTypeForClient() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGenerateCertificateForClientPicksRSAKey(t *testing.T) {
+	dir := t.TempDir()
+	ca := &CertificateAuthority{}
+	if err := ca.Generate(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatalf("CertificateAuthority.Generate() error = %v", err)
+	}
+	handler := &TunnelHandler{CA: ca, LeafKeys: NewLeafKeyStore(LeafKeyPerHost, 0)}
+
+	cert, err := handler.generateCertificateForClient("legacy.example", &tls.ClientHelloInfo{
+		SignatureSchemes:  []tls.SignatureScheme{tls.PKCS1WithSHA256},
+		SupportedVersions: []uint16{tls.VersionTLS12},
+	})
+	if err != nil {
+		t.Fatalf("generateCertificateForClient() error = %v", err)
+	}
+	if _, ok := cert.PrivateKey.(*rsa.PrivateKey); !ok {
+		t.Fatalf("leaf private key = %T, want *rsa.PrivateKey", cert.PrivateKey)
+	}
+
+	cert, err = handler.generateCertificateForClient("modern.example", nil)
+	if err != nil {
+		t.Fatalf("generateCertificateForClient() error = %v", err)
+	}
+	if _, ok := cert.PrivateKey.(*ecdsa.PrivateKey); !ok {
+		t.Fatalf("leaf private key = %T, want *ecdsa.PrivateKey", cert.PrivateKey)
+	}
+}
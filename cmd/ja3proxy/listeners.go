@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	listenerUpstreamDirect = "direct"
+	listenerAuthNone       = "none"
+)
+
+type listenerProtocols uint8
+
+const (
+	listenerHTTP listenerProtocols = 1 << iota
+	listenerSOCKS5
+	listenerSOCKS4
+)
+
+var listenerProtocolNames = map[string]listenerProtocols{
+	"http":   listenerHTTP,
+	"socks5": listenerSOCKS5,
+	"socks4": listenerSOCKS4,
+}
+
+func (protocols listenerProtocols) String() string {
+	var names []string
+	for _, name := range []string{"http", "socks5", "socks4"} {
+		if protocols&listenerProtocolNames[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "all"
+	}
+	return strings.Join(names, ",")
+}
+
+func (protocols listenerProtocols) allows(protocol listenerProtocols) bool {
+	return protocols == 0 || protocols&protocol != 0
+}
+
+func parseListenerProtocols(names []string) (listenerProtocols, error) {
+	var protocols listenerProtocols
+	for _, name := range names {
+		protocol, ok := listenerProtocolNames[strings.ToLower(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown protocol %q, want http, socks5 or socks4", name)
+		}
+		protocols |= protocol
+	}
+	return protocols, nil
+}
+
+type ListenerConfig struct {
+	Listen            string   `json:"listen"`
+	Protocols         []string `json:"protocols"`
+	Client            string   `json:"client"`
+	Version           string   `json:"version"`
+	Upstream          string   `json:"upstream"`
+	AuthFile          string   `json:"auth_file"`
+	TLSCert           string   `json:"tls_cert"`
+	TLSKey            string   `json:"tls_key"`
+	TLSPlaintext      *bool    `json:"tls_plaintext"`
+	ProxyProtocolFrom string   `json:"proxy_protocol_from"`
+}
+
+func loadListenerFile(path string) ([]ListenerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var listeners []ListenerConfig
+	if err := json.Unmarshal(data, &listeners); err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listeners defined")
+	}
+	for i, listener := range listeners {
+		if listener.Listen == "" {
+			return nil, fmt.Errorf("listener %d: listen is required", i)
+		}
+		if _, _, err := parseListenAddress(listener.Listen); err != nil {
+			return nil, fmt.Errorf("listener %s: %w", listener.Listen, err)
+		}
+		if _, err := parseListenerProtocols(listener.Protocols); err != nil {
+			return nil, fmt.Errorf("listener %s: %w", listener.Listen, err)
+		}
+		if (listener.TLSCert == "") != (listener.TLSKey == "") {
+			return nil, fmt.Errorf("listener %s: tls_cert and tls_key must be set together", listener.Listen)
+		}
+	}
+	return listeners, nil
+}
+
+func parseListenAddress(value string) (string, string, error) {
+	network, address, ok := strings.Cut(value, "://")
+	if !ok {
+		return "tcp", value, nil
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", err
+		}
+	case "unix":
+		if address == "" {
+			return "", "", fmt.Errorf("missing unix socket path")
+		}
+	default:
+		return "", "", fmt.Errorf("unsupported listen network %q", network)
+	}
+	return network, address, nil
+}
+
+func listenProxy(network, address string) (net.Listener, error) {
+	if network == "unix" {
+		if stat, err := os.Stat(address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", address); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("unix socket %s is in use", address)
+			}
+			if err := os.Remove(address); err != nil {
+				return nil, err
+			}
+		}
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		listener.(*net.UnixListener).SetUnlinkOnClose(true)
+		return listener, nil
+	}
+	return net.Listen(network, address)
+}
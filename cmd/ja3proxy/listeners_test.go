@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		value   string
+		network string
+		address string
+	}{
+		{value: "127.0.0.1:8080", network: "tcp", address: "127.0.0.1:8080"},
+		{value: "tcp6://[::1]:8080", network: "tcp6", address: "[::1]:8080"},
+		{value: "unix:///run/ja3proxy.sock", network: "unix", address: "/run/ja3proxy.sock"},
+	}
+	for _, tt := range tests {
+		network, address, err := parseListenAddress(tt.value)
+		if err != nil {
+			t.Fatalf("parseListenAddress(%q) error = %v", tt.value, err)
+		}
+		if network != tt.network || address != tt.address {
+			t.Fatalf("parseListenAddress(%q) = %q %q, want %q %q", tt.value, network, address, tt.network, tt.address)
+		}
+	}
+
+	for _, value := range []string{"udp://127.0.0.1:53", "tcp://127.0.0.1", "unix://"} {
+		if _, _, err := parseListenAddress(value); err == nil {
+			t.Fatalf("parseListenAddress(%q) error = nil, want error", value)
+		}
+	}
+}
+
+func TestParseListenerProtocols(t *testing.T) {
+	protocols, err := parseListenerProtocols([]string{"HTTP", "socks5"})
+	if err != nil {
+		t.Fatalf("parseListenerProtocols() error = %v", err)
+	}
+	if !protocols.allows(listenerHTTP) || !protocols.allows(listenerSOCKS5) || protocols.allows(listenerSOCKS4) {
+		t.Fatalf("protocols = %s, want http,socks5", protocols)
+	}
+	if all := listenerProtocols(0); !all.allows(listenerSOCKS4) {
+		t.Fatal("empty protocol set should allow every protocol")
+	}
+	if _, err := parseListenerProtocols([]string{"ftp"}); err == nil {
+		t.Fatal("parseListenerProtocols() error = nil, want error")
+	}
+}
+
+func TestLoadListenerFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":            `[]`,
+		"missing listen":   `[{"protocols": ["http"]}]`,
+		"bad protocol":     `[{"listen": "127.0.0.1:0", "protocols": ["ftp"]}]`,
+		"bad network":      `[{"listen": "udp://127.0.0.1:0"}]`,
+		"cert without key": `[{"listen": "127.0.0.1:0", "tls_cert": "proxy.pem"}]`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "listeners.json")
+			if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+				t.Fatalf("write listeners: %v", err)
+			}
+			if _, err := loadListenerFile(path); err == nil {
+				t.Fatal("loadListenerFile() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestMixedProxyListenerRejectsDisabledProtocol(t *testing.T) {
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener := newMixedProxyListener(baseListener, NewProxy(nil, nil, nil), mixedListenerOptions{
+		Protocols: listenerSOCKS5,
+	})
+	defer listener.Close()
+
+	conn, err := net.DialTimeout("tcp", baseListener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded, want closed connection")
+	}
+
+	socksConn, err := net.DialTimeout("tcp", baseListener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer socksConn.Close()
+	if err := socksConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	writeSOCKS5Greeting(t, socksConn, socks5NoAuth)
+	readExact(t, socksConn, []byte{socks5Version, socks5NoAuth})
+}
+
+func TestServeListenersFromFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ja3listeners")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "proxy.sock")
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve port: %v", err)
+	}
+	tcpAddr := tcpListener.Addr().String()
+	tcpListener.Close()
+
+	listenersPath := filepath.Join(dir, "listeners.json")
+	content := `[
+		{"listen": "` + tcpAddr + `", "protocols": ["socks5"], "client": "Firefox", "version": "105"},
+		{"listen": "unix://` + socketPath + `", "protocols": ["http"], "upstream": "direct", "auth_file": "none"}
+	]`
+	if err := os.WriteFile(listenersPath, []byte(content), 0600); err != nil {
+		t.Fatalf("write listeners: %v", err)
+	}
+
+	app := newRuntimeTestApp(t)
+	app.Config.Listeners = listenersPath
+	app.Users = &UserStore{}
+
+	endpoints, err := app.proxyEndpoints(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("proxyEndpoints() error = %v", err)
+	}
+	if got := endpoints[0].handler.configuredTLSFingerprint(); got.Client != "Firefox" || got.Version != "105" {
+		t.Fatalf("first listener fingerprint = %+v, want Firefox 105", got)
+	}
+	if endpoints[0].proxy.users != app.Users || endpoints[1].proxy.users != nil {
+		t.Fatal("listener auth policies were not applied")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- app.serve(ctx, nil)
+	}()
+	defer cancel()
+
+	var unixConn net.Conn
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if unixConn, err = net.Dial("unix", socketPath); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("dial unix listener: %v", err)
+	}
+	defer unixConn.Close()
+	if err := unixConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(unixConn, "GET /missing HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(unixConn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		t.Fatal("unix listener required auth, want auth_file none")
+	}
+
+	tcpConn, err := net.DialTimeout("tcp", tcpAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial tcp listener: %v", err)
+	}
+	defer tcpConn.Close()
+	if err := tcpConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	writeSOCKS5Greeting(t, tcpConn, socks5NoAuth)
+	readExact(t, tcpConn, []byte{socks5Version, socks5NoAcceptable})
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("serve() error = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("unix socket left behind after shutdown: %v", err)
+	}
+}
+
+func TestListenProxyReplacesStaleUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ja3proxy")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "proxy.sock")
+
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenProxy("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listenProxy() over a stale socket error = %v", err)
+	}
+	if _, err := listenProxy("unix", socketPath); err == nil {
+		t.Fatal("listenProxy() on a socket in use succeeded")
+	}
+	listener.Close()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatalf("unix socket left behind after close: %v", err)
+	}
+}
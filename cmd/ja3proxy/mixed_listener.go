@@ -2,26 +2,45 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"log"
 	"net"
 	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
-const defaultHTTPConnBack = 64
+const (
+	defaultHTTPConnBack      = 64
+	proxyTLSHandshakeTimeout = 10 * time.Second
+)
+
+type mixedListenerOptions struct {
+	Protocols         listenerProtocols
+	TLSConfig         *tls.Config
+	TLSPlaintext      bool
+	ProxyProtocolFrom []*net.IPNet
+}
 
 type mixedProxyListener struct {
-	base      net.Listener
-	proxy     *Proxy
-	httpConns chan net.Conn
-	done      chan struct{}
-	closeOnce sync.Once
+	base        net.Listener
+	proxy       *Proxy
+	options     mixedListenerOptions
+	http2Server *http2.Server
+	httpConns   chan net.Conn
+	done        chan struct{}
+	closeOnce   sync.Once
 }
 
-func newMixedProxyListener(base net.Listener, proxy *Proxy) net.Listener {
+func newMixedProxyListener(base net.Listener, proxy *Proxy, options mixedListenerOptions) net.Listener {
 	listener := &mixedProxyListener{
-		base:      base,
-		proxy:     proxy,
-		httpConns: make(chan net.Conn, defaultHTTPConnBack),
-		done:      make(chan struct{}),
+		base:        base,
+		proxy:       proxy,
+		options:     options,
+		http2Server: &http2.Server{},
+		httpConns:   make(chan net.Conn, defaultHTTPConnBack),
+		done:        make(chan struct{}),
 	}
 	go listener.acceptLoop()
 	return listener
@@ -61,6 +80,19 @@ func (listener *mixedProxyListener) acceptLoop() {
 }
 
 func (listener *mixedProxyListener) route(conn net.Conn) {
+	if containsIP(listener.options.ProxyProtocolFrom, conn.RemoteAddr()) {
+		proxiedConn, err := readProxyProtocol(conn)
+		if err != nil {
+			conn.Close()
+			log.Printf("PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		conn = proxiedConn
+	}
+	listener.routeStream(conn, listener.options.TLSConfig != nil)
+}
+
+func (listener *mixedProxyListener) routeStream(conn net.Conn, allowTLS bool) {
 	reader := bufio.NewReader(conn)
 	first, err := reader.Peek(1)
 	if err != nil {
@@ -72,9 +104,45 @@ func (listener *mixedProxyListener) route(conn net.Conn) {
 		Conn:   conn,
 		reader: reader,
 	}
-	if first[0] == socks5Version {
+	protocol := listenerHTTP
+	http2Preface := false
+	switch first[0] {
+	case socks5Version:
+		protocol = listenerSOCKS5
+	case socks4Version:
+		protocol = listenerSOCKS4
+	case tlsHandshakeRecord:
+		if allowTLS {
+			listener.routeTLS(bufferedConn)
+			return
+		}
+	case http2ClientPreface[0]:
+		http2Preface = peekHTTP2Preface(reader)
+	}
+	// A TLS listener only takes plaintext when asked to, so credentials and
+	// targets do not cross the network in clear by accident.
+	if allowTLS && !listener.options.TLSPlaintext {
+		conn.Close()
+		log.Printf("rejected plaintext %s from %s: TLS required on %s", protocol, conn.RemoteAddr(), listener.Addr())
+		return
+	}
+	if !listener.options.Protocols.allows(protocol) {
+		conn.Close()
+		log.Printf("rejected %s from %s: protocol disabled on %s", protocol, conn.RemoteAddr(), listener.Addr())
+		return
+	}
+
+	switch protocol {
+	case listenerSOCKS5:
 		listener.proxy.handleSOCKS5(bufferedConn)
 		return
+	case listenerSOCKS4:
+		listener.proxy.handleSOCKS4(bufferedConn)
+		return
+	}
+	if http2Preface {
+		listener.serveHTTP2(bufferedConn)
+		return
 	}
 
 	select {
@@ -83,3 +151,31 @@ func (listener *mixedProxyListener) route(conn net.Conn) {
 		conn.Close()
 	}
 }
+
+func (listener *mixedProxyListener) routeTLS(conn net.Conn) {
+	tlsConn := tls.Server(conn, listener.options.TLSConfig)
+	if err := tlsConn.SetDeadline(time.Now().Add(proxyTLSHandshakeTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		log.Printf("proxy TLS handshake with %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if err := tlsConn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return
+	}
+
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		if !listener.options.Protocols.allows(listenerHTTP) {
+			tlsConn.Close()
+			log.Printf("rejected %s from %s: protocol disabled on %s", listenerHTTP, conn.RemoteAddr(), listener.Addr())
+			return
+		}
+		listener.serveHTTP2(tlsConn)
+		return
+	}
+	listener.routeStream(tlsConn, false)
+}
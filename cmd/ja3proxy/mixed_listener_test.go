@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTLSMixedProxyServer(t *testing.T, proxy *Proxy, plaintext bool) string {
+	t.Helper()
+
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{localTLSCertificate(t)},
+		NextProtos:   []string{"http/1.1"},
+	}
+	server := &http.Server{
+		Handler: proxy,
+	}
+	go func() {
+		_ = server.Serve(newMixedProxyListener(baseListener, proxy, mixedListenerOptions{TLSConfig: tlsConfig, TLSPlaintext: plaintext}))
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return baseListener.Addr().String()
+}
+
+func TestMixedProxyListenerServesHTTPSProxy(t *testing.T) {
+	proxy := NewProxy(nil, nil, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "http://example.com/resource" {
+			t.Errorf("upstream URL = %q, want http://example.com/resource", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("https proxy")),
+		}, nil
+	}))
+	addr := newTLSMixedProxyServer(t, proxy, false)
+
+	client := newProxyHTTPClient(t, "https://"+addr, &tls.Config{InsecureSkipVerify: true})
+	resp, err := client.Get("http://example.com/resource")
+	if err != nil {
+		t.Fatalf("request through https proxy: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "https proxy" {
+		t.Fatalf("response = %d %q, want 200 https proxy", resp.StatusCode, body)
+	}
+}
+
+func TestMixedProxyListenerRoutesSOCKS5InsideTLS(t *testing.T) {
+	addr := newTLSMixedProxyServer(t, NewProxy(nil, nil, nil), false)
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial TLS proxy: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	writeSOCKS5Greeting(t, conn, socks5NoAuth)
+	readExact(t, conn, []byte{socks5Version, socks5NoAuth})
+}
+
+func TestMixedProxyListenerRequiresTLSUnlessPlaintextAllowed(t *testing.T) {
+	for _, plaintext := range []bool{false, true} {
+		addr := newTLSMixedProxyServer(t, NewProxy(nil, nil, nil), plaintext)
+
+		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			t.Fatalf("set deadline: %v", err)
+		}
+		writeSOCKS5Greeting(t, conn, socks5NoAuth)
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		conn.Close()
+		if plaintext && err != nil {
+			t.Fatalf("plaintext SOCKS5 with plaintext allowed: %v", err)
+		}
+		if !plaintext && err == nil {
+			t.Fatal("plaintext SOCKS5 was served on a TLS-only listener")
+		}
+	}
+}
+
+func TestMixedProxyListenerWithoutTLSConfigIgnoresTLS(t *testing.T) {
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	proxy := NewProxy(nil, nil, nil)
+	server := &http.Server{
+		Handler: proxy,
+	}
+	go func() {
+		_ = server.Serve(newMixedProxyListener(baseListener, proxy, mixedListenerOptions{}))
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 2 * time.Second}, "tcp", baseListener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		conn.Close()
+		t.Fatal("TLS handshake succeeded without a proxy TLS config")
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+	"golang.org/x/net/http2"
+)
+
+const tlsUpgradeHeader = "X-Ja3proxy-Upgrade"
+
+const (
+	originTLSHandshakeTimeout   = 10 * time.Second
+	originResponseHeaderTimeout = 30 * time.Second
+	originIdleConnTimeout       = 90 * time.Second
+)
+
+var errOriginHTTP2 = errors.New("origin switched to HTTP/2")
+
+// originTransport sends https requests over uTLS connections. The preset's
+// ALPN list is offered unchanged, so the ClientHello matches the browser, and
+// origins that pick h2 are spoken to over HTTP/2.
+//
+// Connections are pooled per session and upstream credentials, so a request
+// never rides a connection dialed with another client's upstream, credentials
+// or fingerprint.
+type originTransport struct {
+	handler *TunnelHandler
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	mu    sync.Mutex
+	pools map[string]*originPool
+}
+
+type originPool struct {
+	transport *originTransport
+	http1     *http.Transport
+	http2     *http2.Transport
+
+	// Guarded by originTransport.mu.
+	lastUsed time.Time
+	h2Conns  map[string]*http2.ClientConn
+	h1Addrs  map[string]bool
+	h1Conns  map[string][]net.Conn
+}
+
+func (handler *TunnelHandler) OriginTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) http.RoundTripper {
+	return &originTransport{
+		handler: handler,
+		dial:    dial,
+		pools:   make(map[string]*originPool),
+	}
+}
+
+// originPoolKey names the connection pool for ctx: the client's session,
+// which pins the upstream and fingerprint, and its upstream credentials.
+func originPoolKey(ctx context.Context) string {
+	var key string
+	if session := upstreamSessionFrom(ctx); session != nil {
+		key = session.key
+	}
+	if auth := upstreamAuthFrom(ctx); auth != nil {
+		key += "\x00" + auth.String()
+	}
+	return key
+}
+
+// pool returns the pool for ctx and closes pools of other sessions that have
+// been idle for longer than originIdleConnTimeout.
+func (t *originTransport) pool(ctx context.Context) *originPool {
+	key := originPoolKey(ctx)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for other, pool := range t.pools {
+		if other != "" && other != key && now.Sub(pool.lastUsed) >= originIdleConnTimeout && pool.closeIdle() {
+			delete(t.pools, other)
+		}
+	}
+	pool := t.pools[key]
+	if pool == nil {
+		pool = t.newPool()
+		t.pools[key] = pool
+	}
+	pool.lastUsed = now
+	return pool
+}
+
+func (t *originTransport) newPool() *originPool {
+	pool := &originPool{
+		transport: t,
+		h2Conns:   make(map[string]*http2.ClientConn),
+		h1Addrs:   make(map[string]bool),
+		h1Conns:   make(map[string][]net.Conn),
+	}
+	pool.http1 = &http.Transport{
+		DialContext:           t.dial,
+		DialTLSContext:        pool.dialHTTP1,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       originIdleConnTimeout,
+		ResponseHeaderTimeout: originResponseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	// ConfigureTransports only fails for a transport that already has h2.
+	pool.http2, _ = http2.ConfigureTransports(pool.http1)
+	return pool
+}
+
+// closeIdle closes the pool's connections and reports whether none of them
+// was still carrying a request. Called with originTransport.mu held.
+func (pool *originPool) closeIdle() bool {
+	for _, cc := range pool.h2Conns {
+		if cc.State().StreamsActive > 0 {
+			return false
+		}
+	}
+	for _, cc := range pool.h2Conns {
+		cc.Close()
+	}
+	for _, conns := range pool.h1Conns {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	pool.http1.CloseIdleConnections()
+	return true
+}
+
+func (t *originTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool := t.pool(req.Context())
+	if req.URL.Scheme != "https" {
+		return pool.http1.RoundTrip(req)
+	}
+	addr := upgradeAddress(req.URL)
+	for {
+		t.mu.Lock()
+		cc := pool.h2Conns[addr]
+		if cc != nil && !cc.CanTakeNewRequest() {
+			delete(pool.h2Conns, addr)
+			cc = nil
+		}
+		http1 := pool.h1Addrs[addr]
+		t.mu.Unlock()
+
+		if cc != nil {
+			return cc.RoundTrip(req)
+		}
+		if http1 {
+			resp, err := pool.http1.RoundTrip(req)
+			if errors.Is(err, errOriginHTTP2) && (req.Body == nil || req.Body == http.NoBody) {
+				continue
+			}
+			return resp, err
+		}
+		conn, err := t.dialTLS(req.Context(), addr, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := pool.addConn(addr, conn); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// dialTLS dials addr and completes the uTLS handshake within
+// originTLSHandshakeTimeout. Nil nextProtos keeps the preset's ALPN.
+func (t *originTransport) dialTLS(ctx context.Context, addr string, nextProtos []string) (net.Conn, error) {
+	conn, err := t.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(originTLSHandshakeTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn, err := t.handler.customTLSWrap(conn, stripPort(addr), nextProtos)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s: %w", addr, err)
+	}
+	return tlsConn, nil
+}
+
+// addConn hands a new connection to the HTTP/2 pool or to the HTTP/1.1
+// transport, depending on the protocol the origin picked.
+func (pool *originPool) addConn(addr string, conn net.Conn) error {
+	if negotiatedProtocol(conn) != http2.NextProtoTLS {
+		pool.transport.mu.Lock()
+		defer pool.transport.mu.Unlock()
+		pool.h1Addrs[addr] = true
+		pool.h1Conns[addr] = append(pool.h1Conns[addr], conn)
+		return nil
+	}
+
+	cc, err := pool.http2.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	pool.transport.mu.Lock()
+	defer pool.transport.mu.Unlock()
+	delete(pool.h1Addrs, addr)
+	pool.h2Conns[addr] = cc
+	return nil
+}
+
+// dialHTTP1 is the HTTP/1.1 transport's TLS dialer. It first takes the
+// connection RoundTrip dialed to find the origin's protocol.
+func (pool *originPool) dialHTTP1(ctx context.Context, network, addr string) (net.Conn, error) {
+	pool.transport.mu.Lock()
+	if conns := pool.h1Conns[addr]; len(conns) > 0 {
+		pool.h1Conns[addr] = conns[1:]
+		if len(conns) == 1 {
+			delete(pool.h1Conns, addr)
+		}
+		pool.transport.mu.Unlock()
+		return conns[0], nil
+	}
+	pool.transport.mu.Unlock()
+
+	conn, err := pool.transport.dialTLS(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	if negotiatedProtocol(conn) == http2.NextProtoTLS {
+		if err := pool.addConn(addr, conn); err != nil {
+			return nil, err
+		}
+		return nil, errOriginHTTP2
+	}
+	return conn, nil
+}
+
+func negotiatedProtocol(conn net.Conn) string {
+	if uconn, ok := conn.(*utls.UConn); ok {
+		return uconn.ConnectionState().NegotiatedProtocol
+	}
+	return ""
+}
+
+func parseHostPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func (p *Proxy) originateTLS(req *http.Request) bool {
+	upgrade := req.Header.Get(tlsUpgradeHeader)
+	req.Header.Del(tlsUpgradeHeader)
+	if p == nil || p.originTransport == nil {
+		return false
+	}
+
+	if req.URL.Scheme == "http" && (strings.EqualFold(upgrade, "https") || p.matchesTLSUpgrade(req.URL.Hostname())) {
+		req.URL.Scheme = "https"
+		req.URL.Host = strings.TrimSuffix(req.URL.Host, ":80")
+	}
+	return req.URL.Scheme == "https"
+}
+
+func (p *Proxy) matchesTLSUpgrade(host string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range p.tlsUpgradeHosts {
+		if matchHostPattern(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
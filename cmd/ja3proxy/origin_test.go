@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func newOriginTestProxy(t *testing.T) (*Proxy, string, <-chan ja3CaptureResult) {
+	t.Helper()
+
+	handler := newTestTunnelHandler(t, utls.HelloFirefox_63)
+	upstreamAddr, upstreamResults := newJA3CaptureTLSServer(t)
+	_, upstreamPort, err := net.SplitHostPort(upstreamAddr)
+	if err != nil {
+		t.Fatalf("split upstream host: %v", err)
+	}
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	dial := func(network, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(addr, "target.test:") {
+			return nil, fmt.Errorf("addr = %q, want target.test", addr)
+		}
+		return dialer.Dial(network, upstreamAddr)
+	}
+
+	proxy := NewProxy(dial, handler.Connect, nil)
+	proxy.originTransport = handler.OriginTransport(proxy.dialContext)
+	return proxy, upstreamPort, upstreamResults
+}
+
+func assertOriginatedFirefoxJA3(t *testing.T, results <-chan ja3CaptureResult) {
+	t.Helper()
+
+	result := receiveJA3CaptureResult(t, results)
+	if result.err != nil {
+		t.Fatalf("upstream TLS server error = %v", result.err)
+	}
+	if result.serverName != "target.test" {
+		t.Fatalf("upstream SNI = %q, want target.test", result.serverName)
+	}
+	if result.requestURI != "/ja3" {
+		t.Fatalf("upstream request URI = %q, want /ja3", result.requestURI)
+	}
+	expected := expectedUTLSJA3Fingerprint(t, utls.HelloFirefox_63, "target.test", nil)
+	if result.ja3Fingerprint != expected {
+		t.Fatalf("upstream JA3 = %s (%s), want Firefox_63 %s", result.ja3Fingerprint, result.ja3, expected)
+	}
+}
+
+func TestE2EAbsoluteHTTPSRequestOriginatesWithUTLS(t *testing.T) {
+	proxy, upstreamPort, upstreamResults := newOriginTestProxy(t)
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(proxyServer.URL, "http://"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	target := net.JoinHostPort("target.test", upstreamPort)
+	if _, err := io.WriteString(conn, "GET https://"+target+"/ja3 HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("response = %d %q, want 200 ok", resp.StatusCode, body)
+	}
+
+	assertOriginatedFirefoxJA3(t, upstreamResults)
+}
+
+func TestE2EPlainHTTPRequestUpgradedByRule(t *testing.T) {
+	proxy, upstreamPort, upstreamResults := newOriginTestProxy(t)
+	proxy.tlsUpgradeHosts = parseHostPatterns("*.example.com, target.test")
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	client := newProxyHTTPClient(t, proxyServer.URL, nil)
+	resp, err := client.Get("http://" + net.JoinHostPort("target.test", upstreamPort) + "/ja3")
+	if err != nil {
+		t.Fatalf("proxy HTTP request: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("response = %d %q, want 200 ok", resp.StatusCode, body)
+	}
+
+	assertOriginatedFirefoxJA3(t, upstreamResults)
+}
+
+func TestOriginateTLSUpgradeHeader(t *testing.T) {
+	proxy := &Proxy{originTransport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return nil, nil
+	})}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com:80/path", nil)
+	req.Header.Set(tlsUpgradeHeader, "https")
+	if !proxy.originateTLS(req) {
+		t.Fatal("originateTLS() = false, want true for upgrade header")
+	}
+	if req.URL.String() != "https://example.com/path" {
+		t.Fatalf("upgraded URL = %q, want https://example.com/path", req.URL)
+	}
+	if req.Header.Get(tlsUpgradeHeader) != "" {
+		t.Fatal("upgrade header was forwarded")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	if proxy.originateTLS(req) {
+		t.Fatal("originateTLS() = true, want false without a rule or header")
+	}
+
+	var nilProxy *Proxy
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/path", nil)
+	req.Header.Set(tlsUpgradeHeader, "https")
+	if nilProxy.originateTLS(req) || req.URL.Scheme != "http" {
+		t.Fatal("proxy without origin transport upgraded the request")
+	}
+	if req.Header.Get(tlsUpgradeHeader) != "" {
+		t.Fatal("upgrade header was forwarded without origin transport")
+	}
+}
+
+func TestOriginTransportKeepsPresetALPNAndSpeaksHTTP2(t *testing.T) {
+	offered := make(chan []string, 2)
+	var conns atomic.Int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			offered <- hello.SupportedProtos
+			return nil, nil
+		},
+	}
+	origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	handler := newTestTunnelHandler(t, utls.HelloFirefox_63)
+	transport := handler.OriginTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, origin.Listener.Addr().String())
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "https://target.test/", nil)
+		req.RequestURI = ""
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != 2 || string(body) != "HTTP/2.0" {
+			t.Fatalf("response proto = %s, origin saw %q; want HTTP/2.0", resp.Proto, body)
+		}
+	}
+	if got := <-offered; fmt.Sprint(got) != "[h2 http/1.1]" {
+		t.Fatalf("offered ALPN = %v, want the Firefox_63 preset [h2 http/1.1]", got)
+	}
+	if got := conns.Load(); got != 1 {
+		t.Fatalf("origin connections = %d, want 1 reused HTTP/2 connection", got)
+	}
+}
+
+func TestOriginTransportKeepsUpstreamCredentialsApart(t *testing.T) {
+	var conns atomic.Int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	origin.EnableHTTP2 = true
+	origin.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	origin.StartTLS()
+	t.Cleanup(origin.Close)
+
+	dialedAs := make(chan string, 4)
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	handler := newTestTunnelHandler(t, utls.HelloFirefox_63)
+	transport := handler.OriginTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialedAs <- upstreamAuthFrom(ctx).Username()
+		return dialer.DialContext(ctx, network, origin.Listener.Addr().String())
+	})
+
+	for _, user := range []*url.Userinfo{
+		url.UserPassword("team-a", "secret-a"),
+		url.UserPassword("team-b", "secret-b"),
+		url.UserPassword("team-a", "secret-a"),
+		url.UserPassword("team-b", "secret-b"),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "https://target.test/", nil)
+		req.RequestURI = ""
+		req = req.WithContext(withUpstreamAuth(req.Context(), user))
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("RoundTrip() as %s error = %v", user.Username(), err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	close(dialedAs)
+	var dialed []string
+	for user := range dialedAs {
+		dialed = append(dialed, user)
+	}
+	if fmt.Sprint(dialed) != "[team-a team-b]" {
+		t.Fatalf("dialed as %v, want one connection per upstream user", dialed)
+	}
+	if got := conns.Load(); got != 2 {
+		t.Fatalf("origin connections = %d, want 2", got)
+	}
+}
+
+func TestOriginTransportTimesOutTLSHandshake(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				conn.Close()
+			})
+		}
+	}()
+
+	handler := newTestTunnelHandler(t, utls.HelloFirefox_63)
+	transport := handler.OriginTransport(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, listener.Addr().String())
+	}).(*originTransport)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := transport.dialTLS(ctx, "target.test:443", nil); err == nil {
+		t.Fatal("dialTLS() to a silent server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("dialTLS() took %s, want the handshake cut off", elapsed)
+	}
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -33,6 +35,27 @@ type Proxy struct {
 	tunnelDial    func(network, addr string) (net.Conn, error)
 	tunnelConnect func(sni string, destConn net.Conn, clientConn net.Conn)
 	httpTransport http.RoundTripper
+	users         *UserStore
+	udpEgress     func(ctx context.Context) (udpEgress, error)
+	sniRoutes     *SNIRouteStore
+	sniResolver   *net.Resolver
+	sniReject     bool
+	tunnelHTTP    bool
+
+	originTransport http.RoundTripper
+	tlsUpgradeHosts []string
+	via             string
+	forwardedFor    bool
+	debug           bool
+
+	socks5BindPorts    portRange
+	socks5BindTimeout  time.Duration
+	socks5BindDisabled bool
+
+	tunnelDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	sessions          *SessionStore
+	upstreamAuth      string
+	upstreamAuthMap   *UpstreamAuthMap
 }
 
 func NewProxy(
@@ -57,6 +80,15 @@ func NewProxy(
 }
 
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := p.authorizeHTTP(w, r)
+	if !ok {
+		return
+	}
+	if p.debug && p.sessions != nil && isSessionDebugRequest(r) {
+		p.serveSessionDebug(w, r)
+		return
+	}
+	r = r.WithContext(ctx)
 	if r.Method == http.MethodConnect {
 		p.handleTunneling(w, r)
 		return
@@ -71,6 +103,26 @@ func (p *Proxy) dial(network, addr string) (net.Conn, error) {
 	return defaultTunnelDial(network, addr)
 }
 
+// dialFor dials on behalf of a client so an upstream pool can pick a proxy
+// that is sticky to it. ctx carries the client's session, if any.
+func (p *Proxy) dialFor(ctx context.Context, client string, network, addr string) (net.Conn, error) {
+	return p.dialContext(withUpstreamClient(ctx, client), network, addr)
+}
+
+func (p *Proxy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if p != nil && p.tunnelDialContext != nil {
+		conn, err = p.tunnelDialContext(ctx, network, addr)
+	} else {
+		conn, err = p.dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return withSessionConn(ctx, conn), nil
+}
+
 func (p *Proxy) connect(sni string, destConn net.Conn, clientConn net.Conn) {
 	if p != nil && p.tunnelConnect != nil {
 		p.tunnelConnect(sni, destConn, clientConn)
@@ -88,6 +140,10 @@ func (p *Proxy) transport() http.RoundTripper {
 
 func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
 	log.Printf("proxy to %s", r.Host)
+	if r.ProtoMajor == 2 {
+		p.handleHTTP2Tunneling(w, r)
+		return
+	}
 
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
@@ -96,10 +152,10 @@ func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	destConn, err := p.dial("tcp", r.Host)
+	destConn, err := p.dialFor(r.Context(), r.RemoteAddr, "tcp", r.Host)
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		http.Error(w, err.Error(), dialErrorStatus(err))
 		log.Println("Tunneling err: ", err)
 		return
 	}
@@ -112,14 +168,6 @@ func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tunnelClientConn := clientConn
-	if clientRW.Reader.Buffered() > 0 {
-		tunnelClientConn = &bufferedReadConn{
-			Conn:   clientConn,
-			reader: clientRW.Reader,
-		}
-	}
-
 	if _, err := io.WriteString(clientRW, connectEstablishedResponse); err != nil {
 		destConn.Close()
 		clientConn.Close()
@@ -133,7 +181,23 @@ func (p *Proxy) handleTunneling(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go p.connect(stripPort(r.Host), destConn, tunnelClientConn)
+	go p.tunnel(r.Host, destConn, clientConn, clientRW.Reader)
+}
+
+func (p *Proxy) tunnel(target string, destConn net.Conn, clientConn net.Conn, reader *bufio.Reader) {
+	host, portText, err := net.SplitHostPort(target)
+	port, portErr := strconv.ParseUint(portText, 10, 16)
+	if err != nil || portErr != nil {
+		if reader.Buffered() > 0 {
+			clientConn = &bufferedReadConn{
+				Conn:   clientConn,
+				reader: reader,
+			}
+		}
+		p.connect(stripPort(target), destConn, clientConn)
+		return
+	}
+	p.handleSniffedTunnel(host, uint16(port), destConn, clientConn, reader)
 }
 
 func defaultTunnelDial(network, addr string) (net.Conn, error) {
@@ -145,19 +209,40 @@ func defaultTunnelConnect(_ string, destConn net.Conn, clientConn net.Conn) {
 }
 
 func (p *Proxy) handleHTTP(w http.ResponseWriter, req *http.Request) {
-	outReq := req.Clone(req.Context())
+	if p.viaLoop(req.Header) {
+		http.Error(w, "proxy loop detected", http.StatusLoopDetected)
+		log.Printf("proxy loop detected for %s", req.URL)
+		return
+	}
+
+	outReq := req.Clone(withUpstreamClient(req.Context(), req.RemoteAddr))
 	outReq.RequestURI = ""
+	if req.ProtoMajor == 2 && outReq.URL.Host == "" {
+		// HTTP/2 proxy requests carry the target in :authority and do not
+		// keep :scheme; https targets use CONNECT instead.
+		outReq.URL.Scheme = "http"
+		outReq.URL.Host = req.Host
+	}
+	protocol := upgradeProtocol(req.Header)
+	p.prepareForwardRequest(outReq, req)
+
+	transport := p.transport()
+	if p.originateTLS(outReq) {
+		transport = p.originTransport
+	}
+	if protocol != "" {
+		p.handleUpgrade(w, outReq, protocol)
+		return
+	}
 
-	resp, err := p.transport().RoundTrip(outReq)
+	resp, err := transport.RoundTrip(outReq)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusServiceUnavailable)
 		log.Println(err)
 		return
 	}
 	defer resp.Body.Close()
-	copyHeader(w.Header(), resp.Header)
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	p.writeForwardResponse(w, resp)
 }
 
 func copyHeader(dst, src http.Header) {
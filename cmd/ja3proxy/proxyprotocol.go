@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxyProtocolTimeout     = 5 * time.Second
+	proxyProtocolV1MaxLength = 107
+	proxyProtocolV2Header    = 16
+	proxyProtocolV2Local     = 0x00
+	proxyProtocolV2Proxy     = 0x01
+	proxyProtocolV2TCP4      = 0x11
+	proxyProtocolV2TCP6      = 0x21
+)
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errNoProxyProtocolHeader = errors.New("missing PROXY protocol header")
+)
+
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func parseCIDRList(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid CIDR %q", field)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			field = fmt.Sprintf("%s/%d", ip, bits)
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", field)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func readProxyProtocol(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReader(conn)
+	bufferedConn := &bufferedReadConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout)); err != nil {
+		return nil, err
+	}
+	remoteAddr, err := readProxyProtocolHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	if remoteAddr == nil {
+		return bufferedConn, nil
+	}
+	return &proxyProtocolConn{
+		Conn:       bufferedConn,
+		remoteAddr: remoteAddr,
+	}, nil
+}
+
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyProtocolV1Prefix[0]:
+		if prefix, err := reader.Peek(len(proxyProtocolV1Prefix)); err == nil && bytes.Equal(prefix, proxyProtocolV1Prefix) {
+			return readProxyProtocolV1(reader)
+		}
+	case proxyProtocolV2Signature[0]:
+		if signature, err := reader.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+			return readProxyProtocolV2(reader)
+		}
+	}
+	return nil, errNoProxyProtocolHeader
+}
+
+func readProxyProtocolV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyProtocolV1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			return parseProxyProtocolV1(string(line[:len(line)-2]))
+		}
+	}
+	return nil, fmt.Errorf("PROXY v1 header too long")
+}
+
+func parseProxyProtocolV1(line string) (net.Addr, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyProtocolV2Header)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 0x2 {
+		return nil, fmt.Errorf("unsupported PROXY v2 version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0f {
+	case proxyProtocolV2Local:
+		return nil, nil
+	case proxyProtocolV2Proxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command %d", header[12]&0x0f)
+	}
+
+	switch header[13] {
+	case proxyProtocolV2TCP4:
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 TCP4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[0:4]...)),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case proxyProtocolV2TCP6:
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 TCP6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), payload[0:16]...)),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	// UNSPEC and non-TCP families keep the connection's own address.
+	return nil, nil
+}
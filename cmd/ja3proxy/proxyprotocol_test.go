@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func buildProxyProtocolV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte(nil), proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestParseCIDRList(t *testing.T) {
+	networks, err := parseCIDRList("10.0.0.0/8, 192.0.2.1,2001:db8::/32")
+	if err != nil {
+		t.Fatalf("parseCIDRList() error = %v", err)
+	}
+	if len(networks) != 3 {
+		t.Fatalf("networks = %d, want 3", len(networks))
+	}
+
+	tests := map[string]bool{
+		"10.1.2.3":    true,
+		"192.0.2.1":   true,
+		"192.0.2.2":   false,
+		"2001:db8::1": true,
+	}
+	for ip, want := range tests {
+		if got := containsIP(networks, &net.TCPAddr{IP: net.ParseIP(ip)}); got != want {
+			t.Fatalf("containsIP(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	if _, err := parseCIDRList("10.0.0.0/33"); err == nil {
+		t.Fatal("parseCIDRList() error = nil, want error")
+	}
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	tcp4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x1f, 0x90, 0x01, 0xbb}
+	tcp6 := make([]byte, 36)
+	copy(tcp6, net.ParseIP("2001:db8::7"))
+	binary.BigEndian.PutUint16(tcp6[32:], 8080)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+	}{
+		{name: "v1 tcp4", header: []byte("PROXY TCP4 203.0.113.7 10.0.0.1 8080 443\r\n"), want: "203.0.113.7:8080"},
+		{name: "v1 tcp6", header: []byte("PROXY TCP6 2001:db8::7 2001:db8::1 8080 443\r\n"), want: "[2001:db8::7]:8080"},
+		{name: "v1 unknown", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v2 tcp4", header: buildProxyProtocolV2Header(proxyProtocolV2Proxy, proxyProtocolV2TCP4, tcp4), want: "203.0.113.7:8080"},
+		{name: "v2 tcp6", header: buildProxyProtocolV2Header(proxyProtocolV2Proxy, proxyProtocolV2TCP6, tcp6), want: "[2001:db8::7]:8080"},
+		{name: "v2 local", header: buildProxyProtocolV2Header(proxyProtocolV2Local, 0x00, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(append(tt.header, "GET / HTTP/1.1\r\n"...)))
+			addr, err := readProxyProtocolHeader(reader)
+			if err != nil {
+				t.Fatalf("readProxyProtocolHeader() error = %v", err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Fatalf("remote addr = %q, want %q", got, tt.want)
+			}
+
+			rest, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("read rest: %v", err)
+			}
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("rest = %q, want request line", rest)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolHeaderErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"v1 bad address":  []byte("PROXY TCP4 example.com 10.0.0.1 8080 443\r\n"),
+		"v1 mixed family": []byte("PROXY TCP4 2001:db8::7 10.0.0.1 8080 443\r\n"),
+		"v1 too long":     append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...),
+		"v2 short tcp4":   buildProxyProtocolV2Header(proxyProtocolV2Proxy, proxyProtocolV2TCP4, []byte{1, 2, 3}),
+		"v2 bad command":  buildProxyProtocolV2Header(0x0f, proxyProtocolV2TCP4, nil),
+		"no header":       []byte("GET / HTTP/1.1\r\n"),
+	}
+	for name, header := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(header))); err == nil {
+				t.Fatal("readProxyProtocolHeader() error = nil, want error")
+			}
+		})
+	}
+}
+
+func serveRemoteAddrEcho(t *testing.T, trusted string) string {
+	t.Helper()
+
+	networks, err := parseCIDRList(trusted)
+	if err != nil {
+		t.Fatalf("parseCIDRList() error = %v", err)
+	}
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.RemoteAddr)
+		}),
+	}
+	go func() {
+		_ = server.Serve(newMixedProxyListener(baseListener, NewProxy(nil, nil, nil), mixedListenerOptions{
+			ProxyProtocolFrom: networks,
+		}))
+	}()
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return baseListener.Addr().String()
+}
+
+func sendProxyProtocolRequest(t *testing.T, addr string) *http.Response {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	request := "PROXY TCP4 203.0.113.7 10.0.0.1 40000 8080\r\nGET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return resp
+}
+
+func TestMixedProxyListenerUsesProxyProtocolAddress(t *testing.T) {
+	resp := sendProxyProtocolRequest(t, serveRemoteAddrEcho(t, "127.0.0.1"))
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if string(body) != "203.0.113.7:40000" {
+		t.Fatalf("RemoteAddr = %q, want 203.0.113.7:40000", body)
+	}
+}
+
+func TestMixedProxyListenerIgnoresProxyProtocolFromUntrustedSource(t *testing.T) {
+	resp := sendProxyProtocolRequest(t, serveRemoteAddrEcho(t, "10.0.0.0/8"))
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || strings.Contains(string(body), "203.0.113.7") {
+		t.Fatalf("response = %d %q, want 400 without the spoofed address", resp.StatusCode, body)
+	}
+}
+
+func TestMixedProxyListenerRejectsTrustedSourceWithoutProxyProtocol(t *testing.T) {
+	conn, err := net.DialTimeout("tcp", serveRemoteAddrEcho(t, "127.0.0.1"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n"); err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		resp.Body.Close()
+		t.Fatalf("trusted source without a PROXY header got status %d, want the connection closed", resp.StatusCode)
+	}
+}
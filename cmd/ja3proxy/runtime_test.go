@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"flag"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -70,6 +72,68 @@ func TestEnsureCAReturnsErrorWhenOnlyKeyExists(t *testing.T) {
 	}
 }
 
+func TestEnsureCARequiresCertWithExternalSigner(t *testing.T) {
+	app := newRuntimeTestApp(t)
+	dir := t.TempDir()
+	app.Config.Cert = filepath.Join(dir, "cert.pem")
+	app.Config.Key = filepath.Join(dir, "key.pem")
+	app.Config.CASigner = filepath.Join(dir, "signer.sock")
+
+	err := app.ensureCA()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "external signer") {
+		t.Fatalf("error = %q, want external signer context", err)
+	}
+	if fileExists(app.Config.Key) {
+		t.Fatal("ensureCA generated a CA key while using an external signer")
+	}
+}
+
+func TestEnsureCAEphemeralKeepsCAInMemory(t *testing.T) {
+	app := newRuntimeTestApp(t)
+	dir := t.TempDir()
+	app.Config.Cert = filepath.Join(dir, "cert.pem")
+	app.Config.Key = filepath.Join(dir, "key.pem")
+	app.Config.EphemeralCA = true
+	app.Config.EphemeralCAExport = "file:" + filepath.Join(dir, "export", "ca.pem")
+
+	if err := app.ensureCA(); err != nil {
+		t.Fatalf("ensureCA() error = %v", err)
+	}
+	if err := app.loadExistingCA(); err != nil {
+		t.Fatalf("loadExistingCA() error = %v", err)
+	}
+	if err := app.exportEphemeralCA(); err != nil {
+		t.Fatalf("exportEphemeralCA() error = %v", err)
+	}
+
+	if fileExists(app.Config.Cert) || fileExists(app.Config.Key) {
+		t.Fatal("ephemeral CA was written to the configured cert/key paths")
+	}
+	exported, err := os.ReadFile(filepath.Join(dir, "export", "ca.pem"))
+	if err != nil {
+		t.Fatalf("read exported CA: %v", err)
+	}
+	if !strings.Contains(string(exported), "BEGIN CERTIFICATE") || strings.Contains(string(exported), "PRIVATE KEY") {
+		t.Fatalf("exported CA = %q, want certificate only", exported)
+	}
+	if _, err := app.CA.GenerateCertificate(mustGenerateSessionKey(t), "ci.example"); err != nil {
+		t.Fatalf("GenerateCertificate() with ephemeral CA error = %v", err)
+	}
+}
+
+func mustGenerateSessionKey(t *testing.T) SessionKeyHelper {
+	t.Helper()
+
+	session := SessionKeyHelper{}
+	if err := session.Generate(); err != nil {
+		t.Fatalf("SessionKeyHelper.Generate() error = %v", err)
+	}
+	return session
+}
+
 func TestParseFlagsAppliesArgs(t *testing.T) {
 	app := newRuntimeTestApp(t)
 
@@ -78,10 +142,14 @@ func TestParseFlagsAppliesArgs(t *testing.T) {
 		"-key", "custom-key.pem",
 		"-addr", "127.0.0.1",
 		"-port", "9090",
+		"-transparent", ":8443",
+		"-tproxy",
 		"-client", "Chrome",
 		"-version", "120",
 		"-fingerprint-config", "fingerprints.json",
 		"-upstream", "127.0.0.1:1080",
+		"-leaf-key", "per-host",
+		"-leaf-key-rotation", "1h",
 		"-debug",
 	})
 	if err != nil {
@@ -100,6 +168,9 @@ func TestParseFlagsAppliesArgs(t *testing.T) {
 	if app.Config.Port != "9090" {
 		t.Fatalf("port = %q, want 9090", app.Config.Port)
 	}
+	if app.Config.Transparent != ":8443" || !app.Config.TProxy {
+		t.Fatalf("transparent = %q tproxy = %v, want :8443 true", app.Config.Transparent, app.Config.TProxy)
+	}
 	if app.Config.TLSClient != "Chrome" {
 		t.Fatalf("client = %q, want Chrome", app.Config.TLSClient)
 	}
@@ -112,6 +183,12 @@ func TestParseFlagsAppliesArgs(t *testing.T) {
 	if app.Config.Upstream != "127.0.0.1:1080" {
 		t.Fatalf("upstream = %q, want 127.0.0.1:1080", app.Config.Upstream)
 	}
+	if app.Config.LeafKeyMode != "per-host" {
+		t.Fatalf("leaf key mode = %q, want per-host", app.Config.LeafKeyMode)
+	}
+	if app.Config.LeafKeyRotation != time.Hour {
+		t.Fatalf("leaf key rotation = %s, want 1h", app.Config.LeafKeyRotation)
+	}
 	if !app.Config.Debug {
 		t.Fatal("debug = false, want true")
 	}
@@ -135,6 +212,19 @@ func TestParseFlagsReturnsErrorForInvalidFlag(t *testing.T) {
 	}
 }
 
+func TestConfigureLeafKeysReturnsModeError(t *testing.T) {
+	app := newRuntimeTestApp(t)
+	app.Config.LeafKeyMode = "per-request"
+
+	err := app.configureLeafKeys()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "failed configuring leaf keys") {
+		t.Fatalf("error = %q, want leaf key context", err)
+	}
+}
+
 func TestConfigureTLSFingerprintReturnsValidationError(t *testing.T) {
 	app := newRuntimeTestApp(t)
 	app.Config.TLSClient = "UnsupportedClient"
@@ -202,9 +292,9 @@ func TestConfigureTLSFingerprintPassesContextToWatcher(t *testing.T) {
 
 func TestBuildProxyReturnsUpstreamValidationError(t *testing.T) {
 	app := newRuntimeTestApp(t)
-	app.Config.Upstream = "http://127.0.0.1:1080"
+	app.Config.Upstream = "ftp://127.0.0.1:1080"
 
-	proxy, err := app.buildProxy()
+	proxy, err := app.buildProxy(context.Background())
 	if err == nil {
 		t.Fatal("expected error")
 	}
@@ -216,6 +306,85 @@ func TestBuildProxyReturnsUpstreamValidationError(t *testing.T) {
 	}
 }
 
+func TestBuildProxyUsesUpstreamPoolForSeveralUpstreams(t *testing.T) {
+	app := newRuntimeTestApp(t)
+	app.Config.Upstream = "socks5://127.0.0.1:1080, http://127.0.0.1:3128"
+	app.Config.UpstreamStrategy = upstreamStickyHost
+
+	proxy, err := app.buildProxy(context.Background())
+	if err != nil {
+		t.Fatalf("buildProxy() error = %v", err)
+	}
+	pool, ok := proxy.httpTransport.(*UpstreamPool)
+	if !ok {
+		t.Fatalf("transport = %T, want *UpstreamPool", proxy.httpTransport)
+	}
+	if len(pool.members) != 2 || pool.options.Strategy != upstreamStickyHost {
+		t.Fatalf("pool has %d members with strategy %q", len(pool.members), pool.options.Strategy)
+	}
+	if proxy.tunnelDialContext == nil {
+		t.Fatal("tunnelDialContext is not set")
+	}
+
+	app.Config.UpstreamStrategy = "fastest"
+	if _, err := app.buildProxy(context.Background()); err == nil || !strings.Contains(err.Error(), "configure upstream pool") {
+		t.Fatalf("buildProxy() error = %v, want upstream pool context", err)
+	}
+}
+
+func TestBuildProxySingleUpstreamSendsSessionCredentials(t *testing.T) {
+	addr, requests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	app := newRuntimeTestApp(t)
+	app.Config.Upstream = "http://vendor:secret@" + addr
+	app.Sessions = newTestSessionStore(t, "vendor-session-{session}", "", nil)
+
+	proxy, err := app.buildProxy(context.Background())
+	if err != nil {
+		t.Fatalf("buildProxy() error = %v", err)
+	}
+	ctx := withUpstreamSession(context.Background(), app.Sessions.Resolve("alice-session-abc"))
+	conn, err := proxy.dialFor(ctx, "", "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("dialFor() error = %v", err)
+	}
+	conn.Close()
+
+	request := <-requests
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("vendor-session-abc:secret"))
+	if request.authorization != want {
+		t.Fatalf("Proxy-Authorization = %q, want %q", request.authorization, want)
+	}
+}
+
+func TestConfigureUpstreamAuthValidatesMode(t *testing.T) {
+	app := newRuntimeTestApp(t)
+	app.Config.UpstreamAuth = "forward"
+	if err := app.configureUpstreamAuth(context.Background()); err == nil {
+		t.Fatal("expected unknown mode error")
+	}
+
+	app.Config.UpstreamAuth = upstreamAuthMap
+	if err := app.configureUpstreamAuth(context.Background()); err == nil {
+		t.Fatal("expected error for map mode without -upstream-auth-map")
+	}
+
+	app.Config.UpstreamAuthMap = filepath.Join(t.TempDir(), "upstream-auth.txt")
+	if err := os.WriteFile(app.Config.UpstreamAuthMap, []byte("team-a:acct-a:secret\n"), 0o600); err != nil {
+		t.Fatalf("write upstream auth map: %v", err)
+	}
+	if err := app.configureUpstreamAuth(context.Background()); err != nil {
+		t.Fatalf("configureUpstreamAuth() error = %v", err)
+	}
+	if app.UpstreamAuthMap.Lookup("team-a") == nil {
+		t.Fatal("upstream auth map was not loaded")
+	}
+
+	app.Config.UpstreamAuth = upstreamAuthPassthrough
+	if err := app.configureUpstreamAuth(context.Background()); err == nil {
+		t.Fatal("expected error for -upstream-auth-map without map mode")
+	}
+}
+
 func TestServeReturnsCanceledContext(t *testing.T) {
 	app := newRuntimeTestApp(t)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -226,3 +395,79 @@ func TestServeReturnsCanceledContext(t *testing.T) {
 		t.Fatalf("serve() error = %v, want context.Canceled", err)
 	}
 }
+
+func TestProxyTLSConfigRequiresCertAndKey(t *testing.T) {
+	app := newRuntimeTestApp(t)
+	app.Config.ProxyTLSCert = "proxy.pem"
+
+	if _, err := app.proxyTLSConfig(); err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Fatalf("proxyTLSConfig() error = %v, want cert/key pairing error", err)
+	}
+}
+
+func TestUpstreamTLSLoadsCAClientCertAndFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "upstream", "proxy.example.com")
+	app := newRuntimeTestApp(t)
+	app.Config.UpstreamCA = filepath.Join(dir, "upstream.pem")
+	app.Config.UpstreamCert = filepath.Join(dir, "upstream.pem")
+	app.Config.UpstreamKey = filepath.Join(dir, "upstream-key.pem")
+	app.Config.UpstreamTLSClient = "Firefox"
+	app.Config.UpstreamTLSVersion = "63"
+
+	upstreamTLS, err := app.upstreamTLS()
+	if err != nil {
+		t.Fatalf("upstreamTLS() error = %v", err)
+	}
+	if upstreamTLS.Config.RootCAs == nil {
+		t.Fatal("RootCAs not loaded from -upstream-ca")
+	}
+	if len(upstreamTLS.Config.Certificates) != 1 {
+		t.Fatalf("client certificates = %d, want 1", len(upstreamTLS.Config.Certificates))
+	}
+	if upstreamTLS.Fingerprint == nil || upstreamTLS.Fingerprint.Client != "Firefox" {
+		t.Fatalf("fingerprint = %+v, want Firefox", upstreamTLS.Fingerprint)
+	}
+
+	app.Config.UpstreamKey = ""
+	if _, err := app.upstreamTLS(); err == nil || !strings.Contains(err.Error(), "must be set together") {
+		t.Fatalf("upstreamTLS() error = %v, want cert/key pairing error", err)
+	}
+
+	app.Config.UpstreamCert = ""
+	app.Config.UpstreamTLSClient = "NoSuchBrowser"
+	if _, err := app.upstreamTLS(); err == nil {
+		t.Fatal("expected unsupported fingerprint error")
+	}
+}
+
+func TestProxyTLSConfigLoadsKeyPair(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKeyPair(t, dir, "proxy", "proxy.example.com")
+	app := newRuntimeTestApp(t)
+	app.Config.ProxyTLSCert = filepath.Join(dir, "proxy.pem")
+	app.Config.ProxyTLSKey = filepath.Join(dir, "proxy-key.pem")
+
+	config, err := app.proxyTLSConfig()
+	if err != nil {
+		t.Fatalf("proxyTLSConfig() error = %v", err)
+	}
+	if len(config.Certificates) != 1 {
+		t.Fatalf("certificates = %d, want 1", len(config.Certificates))
+	}
+}
+
+func TestNeedsDefaultProxy(t *testing.T) {
+	app := newRuntimeTestApp(t)
+	if !app.needsDefaultProxy() {
+		t.Fatal("default proxy not needed without -listeners")
+	}
+	app.Config.Listeners = "listeners.json"
+	if app.needsDefaultProxy() {
+		t.Fatal("default proxy needed with only -listeners")
+	}
+	app.Config.SNIListen = "127.0.0.1:443"
+	if !app.needsDefaultProxy() {
+		t.Fatal("default proxy not needed for the SNI listener")
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionParam     = "session"
+	sessionDebugPath = "/debug/sessions"
+)
+
+// SessionStore turns proxy usernames such as user-session-abc123-country-de
+// into upstream sessions. A session keeps its upstream proxy, upstream
+// credentials and TLS fingerprint until it has been idle for the idle time.
+type SessionStore struct {
+	idle             time.Duration
+	upstreamUser     string
+	upstreamPassword string
+	fingerprints     []TLSFingerprint
+	keys             map[string]bool
+
+	mu       sync.Mutex
+	sessions map[string]*upstreamSession
+}
+
+type upstreamSession struct {
+	key          string
+	user         string
+	id           string
+	params       map[string]string
+	upstreamAuth *url.Userinfo
+	fingerprint  *TLSFingerprint
+	created      time.Time
+	store        *SessionStore
+
+	// Guarded by SessionStore.mu.
+	lastUsed time.Time
+	upstream string
+}
+
+type sessionInfo struct {
+	Username     string            `json:"username"`
+	User         string            `json:"user"`
+	Session      string            `json:"session"`
+	Params       map[string]string `json:"params"`
+	Upstream     string            `json:"upstream,omitempty"`
+	UpstreamUser string            `json:"upstream_user,omitempty"`
+	Fingerprint  *TLSFingerprint   `json:"fingerprint,omitempty"`
+	Created      time.Time         `json:"created"`
+	LastUsed     time.Time         `json:"last_used"`
+	Expires      time.Time         `json:"expires"`
+}
+
+func NewSessionStore(idle time.Duration, upstreamUser, upstreamPassword string, fingerprints []TLSFingerprint) (*SessionStore, error) {
+	if idle <= 0 {
+		return nil, fmt.Errorf("session idle time must be positive")
+	}
+	if upstreamUser == "" && upstreamPassword != "" {
+		return nil, fmt.Errorf("session upstream password needs an upstream user template")
+	}
+	keys := map[string]bool{sessionParam: true}
+	for _, template := range []string{upstreamUser, upstreamPassword} {
+		for _, name := range templateNames(template) {
+			if name != "user" {
+				keys[name] = true
+			}
+		}
+	}
+	return &SessionStore{
+		idle:             idle,
+		upstreamUser:     upstreamUser,
+		upstreamPassword: upstreamPassword,
+		fingerprints:     fingerprints,
+		keys:             keys,
+		sessions:         make(map[string]*upstreamSession),
+	}, nil
+}
+
+// templateNames returns the lowercased {name} placeholders in template.
+func templateNames(template string) []string {
+	var names []string
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			return names
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return names
+		}
+		names = append(names, strings.ToLower(template[start+1:start+end]))
+		template = template[start+end+1:]
+	}
+}
+
+func parseSessionFingerprints(value string) ([]TLSFingerprint, error) {
+	var fingerprints []TLSFingerprint
+	for _, field := range strings.Split(value, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		client, version, ok := strings.Cut(field, ":")
+		if !ok || client == "" || version == "" {
+			return nil, fmt.Errorf("invalid fingerprint %q, want client:version", field)
+		}
+		fingerprint := TLSFingerprint{Client: client, Version: version}
+		if err := validateTLSFingerprint(fingerprint); err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints, nil
+}
+
+// parseSessionUsername splits user-key-value-key-value into the user and its
+// parameters. Usernames without an even number of trailing fields or without
+// one of the known keys are plain, so a user such as a-b-c stays a-b-c.
+func parseSessionUsername(username string, keys map[string]bool) (string, map[string]string, bool) {
+	fields := strings.Split(username, "-")
+	if len(fields) < 3 || len(fields)%2 == 0 || fields[0] == "" {
+		return username, nil, false
+	}
+	params := make(map[string]string, len(fields)/2)
+	known := false
+	for i := 1; i < len(fields); i += 2 {
+		key := strings.ToLower(fields[i])
+		if key == "" || fields[i+1] == "" {
+			return username, nil, false
+		}
+		params[key] = fields[i+1]
+		known = known || keys[key]
+	}
+	if !known {
+		return username, nil, false
+	}
+	return fields[0], params, true
+}
+
+// BaseUser returns the user to authenticate for a username with session
+// parameters.
+func (s *SessionStore) BaseUser(username string) string {
+	if s == nil {
+		return username
+	}
+	user, _, _ := parseSessionUsername(username, s.keys)
+	return user
+}
+
+// Resolve returns the session for username, or nil when it carries no
+// parameters. Usernames without a session parameter get a new session on
+// every call, so only the credential template applies to them.
+func (s *SessionStore) Resolve(username string) *upstreamSession {
+	if s == nil {
+		return nil
+	}
+	user, params, ok := parseSessionUsername(username, s.keys)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	id := params[sessionParam]
+	if id == "" {
+		return s.newSession(username, user, params, now)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.sessions[username]; ok && now.Sub(session.lastUsed) < s.idle {
+		session.lastUsed = now
+		return session
+	}
+	session := s.newSession(username, user, params, now)
+	s.sessions[username] = session
+	log.Printf("session %s started for %s%s", id, user, session.describe())
+	return session
+}
+
+func (s *SessionStore) newSession(username, user string, params map[string]string, now time.Time) *upstreamSession {
+	session := &upstreamSession{
+		key:      username,
+		user:     user,
+		id:       params[sessionParam],
+		params:   params,
+		created:  now,
+		lastUsed: now,
+		store:    s,
+	}
+	if s.upstreamUser != "" {
+		upstreamUser := session.expand(s.upstreamUser)
+		session.upstreamAuth = url.User(upstreamUser)
+		if s.upstreamPassword != "" {
+			session.upstreamAuth = url.UserPassword(upstreamUser, session.expand(s.upstreamPassword))
+		}
+	}
+	if len(s.fingerprints) > 0 {
+		hash := fnv.New32a()
+		hash.Write([]byte(username))
+		fingerprint := s.fingerprints[hash.Sum32()%uint32(len(s.fingerprints))]
+		session.fingerprint = &fingerprint
+	}
+	return session
+}
+
+// expand fills {user} and {param} placeholders in template. Parameters the
+// client did not send expand to nothing.
+func (session *upstreamSession) expand(template string) string {
+	var expanded strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			break
+		}
+		expanded.WriteString(template[:start])
+		name := template[start+1 : start+end]
+		if name == "user" {
+			expanded.WriteString(session.user)
+		} else {
+			expanded.WriteString(session.params[strings.ToLower(name)])
+		}
+		template = template[start+end+1:]
+	}
+	expanded.WriteString(template)
+	return expanded.String()
+}
+
+func (session *upstreamSession) describe() string {
+	var description strings.Builder
+	if session.upstreamAuth != nil {
+		fmt.Fprintf(&description, ", upstream user %s", session.upstreamAuth.Username())
+	}
+	if session.fingerprint != nil {
+		fmt.Fprintf(&description, ", fingerprint %s %s", session.fingerprint.Client, session.fingerprint.Version)
+	}
+	return description.String()
+}
+
+// Upstream returns the upstream proxy the session is pinned to, if any.
+func (session *upstreamSession) Upstream() string {
+	if session == nil || session.id == "" {
+		return ""
+	}
+	session.store.mu.Lock()
+	defer session.store.mu.Unlock()
+	return session.upstream
+}
+
+// Pin keeps the session on upstream for its remaining lifetime.
+func (session *upstreamSession) Pin(upstream string) {
+	if session == nil || session.id == "" {
+		return
+	}
+	session.store.mu.Lock()
+	defer session.store.mu.Unlock()
+	if session.upstream == upstream {
+		return
+	}
+	if session.upstream == "" {
+		log.Printf("session %s for %s pinned to upstream %s", session.id, session.user, upstream)
+	} else {
+		log.Printf("session %s for %s moved from upstream %s to %s", session.id, session.user, session.upstream, upstream)
+	}
+	session.upstream = upstream
+}
+
+// Expire drops sessions that have been idle for longer than the idle time.
+func (s *SessionStore) Expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, session := range s.sessions {
+		if now.Sub(session.lastUsed) >= s.idle {
+			delete(s.sessions, key)
+			log.Printf("session %s for %s expired after %s idle", session.id, session.user, s.idle)
+		}
+	}
+}
+
+// Start expires idle sessions until ctx is done.
+func (s *SessionStore) Start(ctx context.Context) {
+	interval := min(s.idle, time.Minute)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.Expire(now)
+			}
+		}
+	}()
+}
+
+func (s *SessionStore) Snapshot() []sessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := make([]sessionInfo, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		info := sessionInfo{
+			Username:    session.key,
+			User:        session.user,
+			Session:     session.id,
+			Params:      session.params,
+			Upstream:    session.upstream,
+			Fingerprint: session.fingerprint,
+			Created:     session.created,
+			LastUsed:    session.lastUsed,
+			Expires:     session.lastUsed.Add(s.idle),
+		}
+		if session.upstreamAuth != nil {
+			info.UpstreamUser = session.upstreamAuth.Username()
+		}
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Username < sessions[j].Username
+	})
+	return sessions
+}
+
+type upstreamSessionKey struct{}
+
+// withUpstreamSession makes dials with ctx use the session's upstream,
+// credentials and fingerprint.
+func withUpstreamSession(ctx context.Context, session *upstreamSession) context.Context {
+	if session == nil {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, upstreamSessionKey{}, session)
+	if session.upstreamAuth != nil {
+		ctx = withUpstreamAuth(ctx, session.upstreamAuth)
+	}
+	return ctx
+}
+
+func upstreamSessionFrom(ctx context.Context) *upstreamSession {
+	session, _ := ctx.Value(upstreamSessionKey{}).(*upstreamSession)
+	return session
+}
+
+// sessionConn carries the session and upstream credentials from the dial to
+// the uTLS handshake and to plain HTTP served inside the tunnel.
+type sessionConn struct {
+	net.Conn
+	session      *upstreamSession
+	upstreamAuth *url.Userinfo
+}
+
+func withSessionConn(ctx context.Context, conn net.Conn) net.Conn {
+	session := upstreamSessionFrom(ctx)
+	upstreamAuth := upstreamAuthFrom(ctx)
+	if session == nil && upstreamAuth == nil {
+		return conn
+	}
+	return &sessionConn{
+		Conn:         conn,
+		session:      session,
+		upstreamAuth: upstreamAuth,
+	}
+}
+
+func connSession(conn net.Conn) *upstreamSession {
+	if conn, ok := conn.(*sessionConn); ok {
+		return conn.session
+	}
+	return nil
+}
+
+// withConnSession restores the session and upstream credentials conn was
+// dialed with.
+func withConnSession(ctx context.Context, conn net.Conn) context.Context {
+	sessionConn, ok := conn.(*sessionConn)
+	if !ok {
+		return ctx
+	}
+	if sessionConn.upstreamAuth != nil {
+		ctx = withUpstreamAuth(ctx, sessionConn.upstreamAuth)
+	}
+	if sessionConn.session != nil {
+		ctx = context.WithValue(ctx, upstreamSessionKey{}, sessionConn.session)
+	}
+	return ctx
+}
+
+func isSessionDebugRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && r.ProtoMajor == 1 && !r.URL.IsAbs() && r.URL.Path == sessionDebugPath
+}
+
+// serveSessionDebug lists the sessions of the authenticated user. Without
+// -auth-file the username is not verified, so only loopback clients are
+// answered, with every session.
+func (p *Proxy) serveSessionDebug(w http.ResponseWriter, r *http.Request) {
+	sessions := p.sessions.Snapshot()
+	if p.users != nil {
+		user, _, _ := parseProxyBasicAuth(r.Header.Get("Proxy-Authorization"))
+		user = p.baseUser(user)
+		own := sessions[:0]
+		for _, session := range sessions {
+			if session.User == user {
+				own = append(own, session)
+			}
+		}
+		sessions = own
+	} else if !isLoopbackAddr(r.RemoteAddr) {
+		http.Error(w, "session debug is only served to loopback clients without -auth-file", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(sessions); err != nil {
+		log.Printf("session debug response error: %v", err)
+	}
+}
+
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+func newTestSessionStore(t *testing.T, upstreamUser, upstreamPassword string, fingerprints []TLSFingerprint) *SessionStore {
+	t.Helper()
+
+	sessions, err := NewSessionStore(time.Minute, upstreamUser, upstreamPassword, fingerprints)
+	if err != nil {
+		t.Fatalf("NewSessionStore() error = %v", err)
+	}
+	return sessions
+}
+
+func TestParseSessionUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		user     string
+		params   map[string]string
+		ok       bool
+	}{
+		{username: "alice", user: "alice"},
+		{username: "alice-session-abc123-country-de", user: "alice", params: map[string]string{"session": "abc123", "country": "de"}, ok: true},
+		{username: "alice-Session-abc123", user: "alice", params: map[string]string{"session": "abc123"}, ok: true},
+		{username: "alice-country-de", user: "alice", params: map[string]string{"country": "de"}, ok: true},
+		{username: "alice-smith", user: "alice-smith"},
+		{username: "a-b-c", user: "a-b-c"},
+		{username: "alice-session-", user: "alice-session-"},
+		{username: "-session-abc", user: "-session-abc"},
+	}
+
+	keys := map[string]bool{"session": true, "country": true}
+	for _, tt := range tests {
+		user, params, ok := parseSessionUsername(tt.username, keys)
+		if user != tt.user || ok != tt.ok || fmt.Sprint(params) != fmt.Sprint(tt.params) {
+			t.Fatalf("parseSessionUsername(%q) = %q, %v, %v; want %q, %v, %v", tt.username, user, params, ok, tt.user, tt.params, tt.ok)
+		}
+	}
+}
+
+func TestProxyBaseUserKeepsExistingUsers(t *testing.T) {
+	proxy := NewProxy(nil, nil, nil)
+	proxy.sessions = newTestSessionStore(t, "", "", nil)
+	proxy.users = newTestUserStore(t, map[string]string{"alice": "pw", "bob-session-x": "pw"})
+
+	if got := proxy.baseUser("alice-session-abc"); got != "alice" {
+		t.Fatalf("baseUser(alice-session-abc) = %q, want alice", got)
+	}
+	if got := proxy.baseUser("bob-session-x"); got != "bob-session-x" {
+		t.Fatalf("baseUser(bob-session-x) = %q, want the existing user kept whole", got)
+	}
+	if got := proxy.baseUser("a-b-c"); got != "a-b-c" {
+		t.Fatalf("baseUser(a-b-c) = %q, want a-b-c", got)
+	}
+	ctx, err := proxy.clientContext(context.Background(), "bob-session-x", "pw")
+	if err != nil {
+		t.Fatalf("clientContext() error = %v", err)
+	}
+	if session := upstreamSessionFrom(ctx); session != nil {
+		t.Fatalf("existing user bob-session-x got session %q", session.id)
+	}
+}
+
+func TestParseSessionFingerprints(t *testing.T) {
+	fingerprints, err := parseSessionFingerprints("Firefox:63, Golang:0")
+	if err != nil {
+		t.Fatalf("parseSessionFingerprints() error = %v", err)
+	}
+	if len(fingerprints) != 2 || fingerprints[0] != (TLSFingerprint{Client: "Firefox", Version: "63"}) {
+		t.Fatalf("fingerprints = %v", fingerprints)
+	}
+
+	for _, value := range []string{"Firefox", "Firefox:", "Unknown:1"} {
+		if _, err := parseSessionFingerprints(value); err == nil {
+			t.Fatalf("parseSessionFingerprints(%q) succeeded, want error", value)
+		}
+	}
+}
+
+func TestSessionStoreResolve(t *testing.T) {
+	fingerprints := []TLSFingerprint{{Client: "Firefox", Version: "63"}, {Client: "Golang", Version: "0"}}
+	sessions := newTestSessionStore(t, "customer-{user}-session-{session}-country-{Country}-city-{city}", "", fingerprints)
+
+	if session := sessions.Resolve("alice"); session != nil {
+		t.Fatalf("plain username resolved to session %q", session.id)
+	}
+
+	session := sessions.Resolve("alice-session-abc123-country-de")
+	if session == nil {
+		t.Fatal("Resolve() returned no session")
+	}
+	if got := session.upstreamAuth.Username(); got != "customer-alice-session-abc123-country-de-city-" {
+		t.Fatalf("upstream user = %q", got)
+	}
+	if _, ok := session.upstreamAuth.Password(); ok {
+		t.Fatal("upstream password set without a password template")
+	}
+	if session.fingerprint == nil {
+		t.Fatal("session has no fingerprint")
+	}
+	if again := sessions.Resolve("alice-session-abc123-country-de"); again != session {
+		t.Fatal("same username did not resolve to the same session")
+	}
+	if other := sessions.Resolve("alice-session-xyz-country-de"); other == session {
+		t.Fatal("different session ID resolved to the same session")
+	}
+
+	sessionless := sessions.Resolve("alice-country-de")
+	if sessionless == nil || sessionless.id != "" || sessionless == sessions.Resolve("alice-country-de") {
+		t.Fatal("username without a session ID should get a fresh, unpinned session")
+	}
+	if got := len(sessions.Snapshot()); got != 2 {
+		t.Fatalf("snapshot has %d sessions, want 2", got)
+	}
+
+	sessions.Expire(time.Now().Add(time.Minute))
+	if got := len(sessions.Snapshot()); got != 0 {
+		t.Fatalf("snapshot has %d sessions after expiry, want 0", got)
+	}
+	if renewed := sessions.Resolve("alice-session-abc123-country-de"); renewed == session {
+		t.Fatal("expired session was reused")
+	}
+}
+
+func TestSessionStoreRequiresUserTemplateForPassword(t *testing.T) {
+	if _, err := NewSessionStore(time.Minute, "", "{session}", nil); err == nil {
+		t.Fatal("expected error for a password template without a user template")
+	}
+	if _, err := NewSessionStore(0, "", "", nil); err == nil {
+		t.Fatal("expected error for a zero idle time")
+	}
+}
+
+func TestSessionPinsUpstreamAndSendsCredentials(t *testing.T) {
+	firstAddr, firstRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	secondAddr, secondRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	pool := newTestUpstreamPool(t, []string{"http://vendor:secret@" + firstAddr, "http://vendor:secret@" + secondAddr}, UpstreamPoolOptions{})
+
+	proxy := NewProxy(pool.Dial, nil, pool)
+	proxy.tunnelDialContext = pool.DialContext
+	proxy.sessions = newTestSessionStore(t, "vendor-session-{session}-country-{country}", "", nil)
+	proxy.users = newTestUserStore(t, map[string]string{"alice": "pw"})
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	for i := 0; i < 4; i++ {
+		conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial proxy: %v", err)
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte("alice-session-abc-country-de:pw"))
+		fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nProxy-Authorization: Basic %s\r\n\r\n", credentials)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read CONNECT response: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+		}
+		conn.Close()
+	}
+
+	var hits [2]int
+	var authorization string
+	for i, requests := range []<-chan connectProxyRequest{firstRequests, secondRequests} {
+		for receivedRequest := true; receivedRequest; {
+			select {
+			case request := <-requests:
+				hits[i]++
+				authorization = request.authorization
+			case <-time.After(100 * time.Millisecond):
+				receivedRequest = false
+			}
+		}
+	}
+	if hits[0]+hits[1] != 4 || (hits[0] != 0 && hits[1] != 0) {
+		t.Fatalf("upstream hits = %v, want all four on one upstream", hits)
+	}
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("vendor-session-abc-country-de:secret"))
+	if authorization != want {
+		t.Fatalf("Proxy-Authorization = %q, want %q", authorization, want)
+	}
+
+	snapshot := proxy.sessions.Snapshot()
+	if len(snapshot) != 1 || snapshot[0].Upstream == "" || snapshot[0].UpstreamUser != "vendor-session-abc-country-de" {
+		t.Fatalf("snapshot = %+v", snapshot)
+	}
+}
+
+func TestSessionFingerprintAppliesToMITM(t *testing.T) {
+	handler := newTestTunnelHandler(t, utls.HelloGolang)
+
+	const targetHost = "target.test"
+	upstreamAddr, upstreamResults := newJA3CaptureTLSServer(t)
+	_, upstreamPort, err := net.SplitHostPort(upstreamAddr)
+	if err != nil {
+		t.Fatalf("split upstream host: %v", err)
+	}
+	dialer := &net.Dialer{Timeout: 2 * time.Second}
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		return dialer.Dial(network, upstreamAddr)
+	}, handler.Connect, nil)
+	proxy.sessions = newTestSessionStore(t, "", "", []TLSFingerprint{{Client: "Firefox", Version: "63"}})
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(handler.CA.x509Cert)
+	client := newProxyHTTPClient(t, strings.Replace(proxyServer.URL, "http://", "http://alice-session-s1:pw@", 1), &tls.Config{
+		RootCAs: roots,
+	})
+	resp, err := client.Get("https://" + net.JoinHostPort(targetHost, upstreamPort) + "/ja3")
+	if err != nil {
+		t.Fatalf("proxy HTTPS request: %v", err)
+	}
+	resp.Body.Close()
+
+	result := receiveJA3CaptureResult(t, upstreamResults)
+	if result.err != nil {
+		t.Fatalf("upstream TLS server error = %v", result.err)
+	}
+	if want := expectedUTLSJA3Fingerprint(t, utls.HelloFirefox_63, targetHost, []string{"http/1.1"}); result.ja3Fingerprint != want {
+		t.Fatalf("upstream JA3 = %s, want the session's Firefox_63 %s", result.ja3Fingerprint, want)
+	}
+}
+
+func TestServeHTTPSessionDebug(t *testing.T) {
+	proxy := NewProxy(nil, nil, nil)
+	proxy.sessions = newTestSessionStore(t, "", "", nil)
+	proxy.sessions.Resolve("alice-session-abc-country-de")
+	proxy.sessions.Resolve("bob-session-xyz")
+
+	serve := func(remoteAddr, credentials string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, sessionDebugPath, nil)
+		req.RemoteAddr = remoteAddr
+		if credentials != "" {
+			req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+		}
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) []sessionInfo {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status code = %d, want %d", rec.Code, http.StatusOK)
+		}
+		var sessions []sessionInfo
+		if err := json.NewDecoder(rec.Body).Decode(&sessions); err != nil {
+			t.Fatalf("decode sessions: %v", err)
+		}
+		return sessions
+	}
+
+	if rec := serve("127.0.0.1:4000", ""); rec.Code == http.StatusOK {
+		t.Fatal("session debug was served without -debug")
+	}
+
+	proxy.debug = true
+	if rec := serve("192.0.2.1:4000", ""); rec.Code != http.StatusForbidden {
+		t.Fatalf("remote client without -auth-file got status %d, want 403", rec.Code)
+	}
+	if sessions := decode(serve("127.0.0.1:4000", "")); len(sessions) != 2 {
+		t.Fatalf("loopback sessions = %+v, want both", sessions)
+	}
+
+	proxy.users = newTestUserStore(t, map[string]string{"alice": "pw", "bob": "pw"})
+	sessions := decode(serve("192.0.2.1:4000", "alice:pw"))
+	if len(sessions) != 1 || sessions[0].Session != "abc" || sessions[0].Params["country"] != "de" {
+		t.Fatalf("alice sees sessions %+v, want only her own", sessions)
+	}
+}
+
+func TestHandleSOCKS5AsksForUsernameWithSessions(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	if err := clientConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	dialed := make(chan *upstreamSession, 1)
+	proxy := NewProxy(nil, nil, nil)
+	proxy.tunnelDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- upstreamSessionFrom(ctx)
+		return nil, io.EOF
+	}
+	proxy.sessions = newTestSessionStore(t, "", "", nil)
+	go proxy.handleSOCKS5(serverConn)
+
+	writeSOCKS5Greeting(t, clientConn, socks5UserPass)
+	readExact(t, clientConn, []byte{socks5Version, socks5UserPass})
+	writeSOCKS5UserPass(t, clientConn, "alice-session-abc", "anything")
+	readExact(t, clientConn, []byte{socks5AuthVersion, socks5AuthSuccess})
+	writeSOCKS5ConnectRequest(t, clientConn, "example.com", 80)
+	readExact(t, clientConn, []byte{socks5Version, socks5GeneralFail, socks5Reserved, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	if session := <-dialed; session == nil || session.id != "abc" {
+		t.Fatalf("dial session = %+v, want abc", session)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const signerServiceName = "Signer"
+
+type SignerPublicReply struct {
+	PublicKey []byte
+}
+
+type SignerSignArgs struct {
+	Digest        []byte
+	Hash          crypto.Hash
+	PSS           bool
+	PSSSaltLength int
+}
+
+type SignerSignReply struct {
+	Signature []byte
+}
+
+type signerService struct {
+	signer crypto.Signer
+}
+
+func (service *signerService) Public(_ bool, reply *SignerPublicReply) error {
+	der, err := x509.MarshalPKIXPublicKey(service.signer.Public())
+	if err != nil {
+		return err
+	}
+	reply.PublicKey = der
+	return nil
+}
+
+func (service *signerService) Sign(args SignerSignArgs, reply *SignerSignReply) error {
+	var opts crypto.SignerOpts = args.Hash
+	if args.PSS {
+		opts = &rsa.PSSOptions{SaltLength: args.PSSSaltLength, Hash: args.Hash}
+	}
+
+	signature, err := service.signer.Sign(rand.Reader, args.Digest, opts)
+	if err != nil {
+		return err
+	}
+	reply.Signature = signature
+	return nil
+}
+
+func serveSigner(ctx context.Context, listener net.Listener, signer crypto.Signer) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName(signerServiceName, &signerService{signer: signer}); err != nil {
+		return err
+	}
+
+	stopClosingListener := context.AfterFunc(runtimeContext(ctx), func() {
+		_ = listener.Close()
+	})
+	defer stopClosingListener()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil && errors.Is(err, net.ErrClosed) {
+				return ctxErr
+			}
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+type remoteSigner struct {
+	network string
+	addr    string
+	public  crypto.PublicKey
+
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+func dialRemoteSigner(target string) (*remoteSigner, error) {
+	network, addr := "unix", strings.TrimPrefix(target, "unix:")
+	signer := &remoteSigner{network: network, addr: addr}
+
+	client, err := signer.rpcClient()
+	if err != nil {
+		return nil, err
+	}
+	var reply SignerPublicReply
+	if err := client.Call(signerServiceName+".Public", true, &reply); err != nil {
+		return nil, fmt.Errorf("fetch signer public key: %w", err)
+	}
+	public, err := x509.ParsePKIXPublicKey(reply.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parse signer public key: %w", err)
+	}
+	signer.public = public
+
+	return signer, nil
+}
+
+func (signer *remoteSigner) rpcClient() (*rpc.Client, error) {
+	signer.mu.Lock()
+	defer signer.mu.Unlock()
+
+	if signer.client != nil {
+		return signer.client, nil
+	}
+	client, err := rpc.Dial(signer.network, signer.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial signer %s: %w", signer.addr, err)
+	}
+	signer.client = client
+	return client, nil
+}
+
+func (signer *remoteSigner) resetClient(client *rpc.Client) {
+	signer.mu.Lock()
+	defer signer.mu.Unlock()
+
+	if signer.client == client {
+		_ = signer.client.Close()
+		signer.client = nil
+	}
+}
+
+func (signer *remoteSigner) Public() crypto.PublicKey {
+	return signer.public
+}
+
+func (signer *remoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	args := SignerSignArgs{
+		Digest: digest,
+		Hash:   opts.HashFunc(),
+	}
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		args.PSS = true
+		args.PSSSaltLength = pssOpts.SaltLength
+	}
+
+	var reply SignerSignReply
+	for attempt := 0; ; attempt++ {
+		client, err := signer.rpcClient()
+		if err != nil {
+			return nil, err
+		}
+		err = client.Call(signerServiceName+".Sign", args, &reply)
+		if errors.Is(err, rpc.ErrShutdown) || errors.Is(err, io.ErrUnexpectedEOF) {
+			signer.resetClient(client)
+			if attempt == 0 {
+				continue
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		return reply.Signature, nil
+	}
+}
+
+func (signer *remoteSigner) Close() error {
+	signer.mu.Lock()
+	defer signer.mu.Unlock()
+
+	if signer.client == nil {
+		return nil
+	}
+	err := signer.client.Close()
+	signer.client = nil
+	return err
+}
+
+func runSignerCommand(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("signer", flag.ContinueOnError)
+	certPath := flags.String("cert", "credentials/cert.pem", "CA cert")
+	keyPath := flags.String("key", "credentials/key.pem", "CA key")
+	passphraseSource := flags.String("key-passphrase", "", "CA key passphrase source: env:NAME, file:PATH or prompt")
+	socketPath := flags.String("socket", "ja3proxy-signer.sock", "unix socket to listen on")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	passphrase, err := readPassphrase(*passphraseSource)
+	if err != nil {
+		return fmt.Errorf("read CA key passphrase: %w", err)
+	}
+	ca := &CertificateAuthority{}
+	if err := ca.LoadEncrypted(*certPath, *keyPath, passphrase); err != nil {
+		return fmt.Errorf("failed loading CA: %w", err)
+	}
+	signer, ok := ca.tlsCert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("CA private key is not a crypto signer")
+	}
+
+	if stat, err := os.Lstat(*socketPath); err == nil && stat.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(*socketPath)
+	}
+	listener, err := listenPrivateUnix(*socketPath)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", *socketPath, err)
+	}
+	defer os.Remove(*socketPath)
+
+	log.Printf("CA signer listen at %s", *socketPath)
+	return serveSigner(ctx, listener, signer)
+}
+
+// listenPrivateUnix creates the socket inside a fresh 0700 directory, makes it
+// 0600 and only then moves it to path, so no other user can connect while the
+// socket still has umask permissions.
+func listenPrivateUnix(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".ja3proxy-signer-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpPath := filepath.Join(dir, "signer.sock")
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmpPath, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSignerSocket(t *testing.T, ca *CertificateAuthority) string {
+	t.Helper()
+
+	dir, err := os.MkdirTemp("", "ja3signer")
+	if err != nil {
+		t.Fatalf("create socket dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socketPath := filepath.Join(dir, "signer.sock")
+
+	listener, err := listenPrivateUnix(socketPath)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serveSigner(ctx, listener, ca.tlsCert.PrivateKey.(*ecdsa.PrivateKey))
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-served:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("serveSigner() error = %v, want context.Canceled", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("serveSigner did not return after cancel")
+		}
+	})
+
+	return socketPath
+}
+
+func TestRemoteSignerGeneratesCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+	localCA := &CertificateAuthority{}
+	if err := localCA.Generate(certPath, keyPath); err != nil {
+		t.Fatalf("CertificateAuthority.Generate() error = %v", err)
+	}
+	socketPath := newTestSignerSocket(t, localCA)
+
+	signer, err := dialRemoteSigner("unix:" + socketPath)
+	if err != nil {
+		t.Fatalf("dialRemoteSigner() error = %v", err)
+	}
+	defer signer.Close()
+
+	ca := &CertificateAuthority{}
+	if err := ca.LoadWithSigner(certPath, signer); err != nil {
+		t.Fatalf("CertificateAuthority.LoadWithSigner() error = %v", err)
+	}
+	session := &SessionKeyHelper{}
+	if err := session.Generate(); err != nil {
+		t.Fatalf("SessionKeyHelper.Generate() error = %v", err)
+	}
+
+	cert, err := ca.GenerateCertificate(*session, "remote.example:443")
+	if err != nil {
+		t.Fatalf("GenerateCertificate() error = %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	if err := leaf.CheckSignatureFrom(localCA.x509Cert); err != nil {
+		t.Fatalf("leaf signature check error = %v", err)
+	}
+}
+
+func TestListenPrivateUnixCreatesOwnerOnlySocket(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "signer.sock")
+	listener, err := listenPrivateUnix(socketPath)
+	if err != nil {
+		t.Fatalf("listenPrivateUnix() error = %v", err)
+	}
+	defer listener.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket mode = %s, want a 0600 socket", info.Mode())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("dir has %d entries, want only the socket", len(entries))
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("dial socket: %v", err)
+	}
+	conn.Close()
+}
+
+func TestLoadWithSignerRejectsMismatchedKey(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+	if err := (&CertificateAuthority{}).Generate(certPath, keyPath); err != nil {
+		t.Fatalf("CertificateAuthority.Generate() error = %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	if err := (&CertificateAuthority{}).LoadWithSigner(certPath, otherKey); err == nil {
+		t.Fatal("LoadWithSigner() error = nil, want mismatch error")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sniDefaultPort = "443"
+
+const (
+	sniUnmatchedResolve = "resolve"
+	sniUnmatchedReject  = "reject"
+)
+
+var errSNIUnmatched = errors.New("no SNI route matches")
+
+// sniRejectUnmatched parses -sni-unmatched. Without a value, unmatched hosts
+// are refused once routes are configured.
+func sniRejectUnmatched(mode string, hasRoutes bool) (bool, error) {
+	switch mode {
+	case "":
+		return hasRoutes, nil
+	case sniUnmatchedResolve:
+		return false, nil
+	case sniUnmatchedReject:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown mode %q, want %s or %s", mode, sniUnmatchedResolve, sniUnmatchedReject)
+	}
+}
+
+type SNIRoute struct {
+	Host   string `json:"host"`
+	Target string `json:"target"`
+}
+
+type SNIRouteStore struct {
+	mu     sync.RWMutex
+	routes []SNIRoute
+}
+
+func (s *SNIRouteStore) Lookup(sni string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	sni = strings.ToLower(sni)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, route := range s.routes {
+		if matchHostPattern(route.Host, sni) {
+			return route.Target, true
+		}
+	}
+	return "", false
+}
+
+func (s *SNIRouteStore) Set(routes []SNIRoute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.routes = routes
+}
+
+func loadSNIRouteFile(path string) ([]SNIRoute, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []SNIRoute
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, err
+	}
+	for i, route := range routes {
+		if route.Host == "" {
+			return nil, fmt.Errorf("route %d: host is required", i)
+		}
+		if route.Target == "" {
+			return nil, fmt.Errorf("route %s: target is required", route.Host)
+		}
+		if _, _, err := net.SplitHostPort(route.Target); err != nil {
+			route.Target = net.JoinHostPort(route.Target, sniDefaultPort)
+		}
+		route.Host = strings.ToLower(route.Host)
+		routes[i] = route
+	}
+	return routes, nil
+}
+
+func (s *SNIRouteStore) ApplyFile(path string) error {
+	routes, err := loadSNIRouteFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.Set(routes)
+	log.Printf("loaded %d SNI routes from %s", len(routes), path)
+	return nil
+}
+
+func (s *SNIRouteStore) WatchFile(ctx context.Context, path string, interval time.Duration) error {
+	return watchFiles(ctx, interval, "SNI routes", func() []string {
+		return []string{path}
+	}, func() error {
+		return s.ApplyFile(path)
+	})
+}
+
+func newDNSResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (p *Proxy) sniTarget(sni string) (string, error) {
+	if target, ok := p.sniRoutes.Lookup(sni); ok {
+		return target, nil
+	}
+	if p.sniReject {
+		return "", errSNIUnmatched
+	}
+	if p.sniResolver == nil {
+		return net.JoinHostPort(sni, sniDefaultPort), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := p.sniResolver.LookupHost(ctx, sni)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(addrs[0], sniDefaultPort), nil
+}
+
+func (p *Proxy) serveSNI(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleSNI(conn)
+	}
+}
+
+func (p *Proxy) handleSNI(conn net.Conn) {
+	reader := bufio.NewReaderSize(conn, clientHelloReaderSize)
+	sni, err := readClientHelloSNI(conn, reader)
+	if err == nil && sni == "" {
+		err = fmt.Errorf("ClientHello has no SNI")
+	}
+	if err != nil {
+		conn.Close()
+		log.Printf("SNI listener ClientHello from %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	target, err := p.sniTarget(sni)
+	if err != nil {
+		conn.Close()
+		log.Printf("SNI listener target for %s: %v", sni, err)
+		return
+	}
+
+	log.Printf("sni proxy %s to %s", sni, target)
+	destConn, err := p.dialFor(context.Background(), conn.RemoteAddr().String(), "tcp", target)
+	if err != nil {
+		conn.Close()
+		log.Printf("SNI listener dial error: %v", err)
+		return
+	}
+
+	p.connect(sni, destConn, &bufferedReadConn{
+		Conn:   conn,
+		reader: reader,
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeSNIRoutes(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("write routes: %v", err)
+	}
+	return path
+}
+
+func TestSNIRouteStoreLookup(t *testing.T) {
+	store := &SNIRouteStore{}
+	path := writeSNIRoutes(t, `[
+		{"host": "api.example.com", "target": "10.0.0.1:8443"},
+		{"host": "*.Example.com", "target": "10.0.0.2"}
+	]`)
+	if err := store.ApplyFile(path); err != nil {
+		t.Fatalf("ApplyFile() error = %v", err)
+	}
+
+	tests := map[string]string{
+		"api.example.com": "10.0.0.1:8443",
+		"WWW.example.com": "10.0.0.2:443",
+	}
+	for sni, want := range tests {
+		if got, ok := store.Lookup(sni); !ok || got != want {
+			t.Fatalf("Lookup(%q) = %q, %v, want %q", sni, got, ok, want)
+		}
+	}
+	if _, ok := store.Lookup("example.org"); ok {
+		t.Fatal("Lookup(example.org) matched, want no route")
+	}
+}
+
+func TestLoadSNIRouteFileErrors(t *testing.T) {
+	tests := map[string]string{
+		"invalid json":   `{`,
+		"missing host":   `[{"target": "10.0.0.1"}]`,
+		"missing target": `[{"host": "example.com"}]`,
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := loadSNIRouteFile(writeSNIRoutes(t, content)); err == nil {
+				t.Fatal("loadSNIRouteFile() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestSNITargetDefaultsToSNIHost(t *testing.T) {
+	proxy := NewProxy(nil, nil, nil)
+
+	target, err := proxy.sniTarget("www.example.com")
+	if err != nil {
+		t.Fatalf("sniTarget() error = %v", err)
+	}
+	if target != "www.example.com:443" {
+		t.Fatalf("sniTarget() = %q, want www.example.com:443", target)
+	}
+}
+
+func TestSNITargetRejectsUnmatchedHosts(t *testing.T) {
+	proxy := NewProxy(nil, nil, nil)
+	proxy.sniRoutes = &SNIRouteStore{}
+	proxy.sniRoutes.Set([]SNIRoute{{Host: "*.example.com", Target: "10.0.0.2:443"}})
+	proxy.sniReject = true
+
+	if target, err := proxy.sniTarget("api.example.com"); err != nil || target != "10.0.0.2:443" {
+		t.Fatalf("sniTarget(api.example.com) = %q, %v; want 10.0.0.2:443", target, err)
+	}
+	if target, err := proxy.sniTarget("www.example.org"); !errors.Is(err, errSNIUnmatched) {
+		t.Fatalf("sniTarget(www.example.org) = %q, %v; want errSNIUnmatched", target, err)
+	}
+}
+
+func TestSNIRejectUnmatched(t *testing.T) {
+	tests := []struct {
+		mode      string
+		hasRoutes bool
+		want      bool
+	}{
+		{"", false, false},
+		{"", true, true},
+		{sniUnmatchedResolve, true, false},
+		{sniUnmatchedReject, false, true},
+	}
+	for _, tt := range tests {
+		got, err := sniRejectUnmatched(tt.mode, tt.hasRoutes)
+		if err != nil || got != tt.want {
+			t.Fatalf("sniRejectUnmatched(%q, %v) = %v, %v; want %v", tt.mode, tt.hasRoutes, got, err, tt.want)
+		}
+	}
+	if _, err := sniRejectUnmatched("allow", true); err == nil {
+		t.Fatal("sniRejectUnmatched(allow) error = nil, want error")
+	}
+}
+
+func TestHandleSNIConnectsRoutedTarget(t *testing.T) {
+	destConn, upstreamPeer := net.Pipe()
+	defer upstreamPeer.Close()
+
+	dialed := make(chan string, 1)
+	connected := make(chan string, 1)
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return destConn, nil
+	}, func(sni string, destConn net.Conn, clientConn net.Conn) {
+		defer destConn.Close()
+		defer clientConn.Close()
+		connected <- sni
+	}, nil)
+	proxy.sniRoutes = &SNIRouteStore{}
+	proxy.sniRoutes.Set([]SNIRoute{{Host: "*.example.com", Target: "10.0.0.2:8443"}})
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go proxy.handleSNI(serverConn)
+	go func() {
+		_ = tls.Client(clientConn, &tls.Config{
+			ServerName:         "www.example.com",
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+
+	select {
+	case addr := <-dialed:
+		if addr != "10.0.0.2:8443" {
+			t.Fatalf("dial addr = %q, want 10.0.0.2:8443", addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for dial")
+	}
+	select {
+	case sni := <-connected:
+		if sni != "www.example.com" {
+			t.Fatalf("connect sni = %q, want www.example.com", sni)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for connect")
+	}
+}
+
+func TestHandleSNIRejectsNonTLS(t *testing.T) {
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		t.Errorf("dial %s for a non-TLS client", addr)
+		return nil, net.ErrClosed
+	}, nil, nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go proxy.handleSNI(serverConn)
+
+	if err := clientConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := clientConn.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if _, err := clientConn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded, want closed connection")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+const (
+	socks4Version      = 0x04
+	socks4Connect      = 0x01
+	socks4Granted      = 0x5a
+	socks4Rejected     = 0x5b
+	socks4MaxFieldSize = 255
+)
+
+type socks4Request struct {
+	command byte
+	host    string
+	port    uint16
+	userID  string
+}
+
+func (request socks4Request) addr() string {
+	return net.JoinHostPort(request.host, strconv.Itoa(int(request.port)))
+}
+
+func (p *Proxy) handleSOCKS4(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	request, err := readSOCKS4Request(reader)
+	if err != nil {
+		_ = writeSOCKS4Reply(conn, socks4Rejected)
+		log.Printf("SOCKS4 request error: %v", err)
+		return
+	}
+	if p != nil && (p.users != nil || p.forwardsCredentials()) {
+		_ = writeSOCKS4Reply(conn, socks4Rejected)
+		log.Printf("SOCKS4 rejected for user-ID %q: proxy authentication is required", request.userID)
+		return
+	}
+	if request.command != socks4Connect {
+		_ = writeSOCKS4Reply(conn, socks4Rejected)
+		log.Printf("SOCKS4 unsupported command: %d", request.command)
+		return
+	}
+
+	destAddr := request.addr()
+	log.Printf("socks4 proxy to %s", destAddr)
+	destConn, err := p.dialFor(context.Background(), conn.RemoteAddr().String(), "tcp", destAddr)
+	if err != nil {
+		_ = writeSOCKS4Reply(conn, socks4Rejected)
+		log.Printf("SOCKS4 dial error: %v", err)
+		return
+	}
+
+	if err := writeSOCKS4Reply(conn, socks4Granted); err != nil {
+		destConn.Close()
+		log.Printf("SOCKS4 reply error: %v", err)
+		return
+	}
+
+	p.handleSniffedTunnel(request.host, request.port, destConn, conn, reader)
+}
+
+func readSOCKS4Request(reader *bufio.Reader) (socks4Request, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return socks4Request{}, err
+	}
+	if header[0] != socks4Version {
+		return socks4Request{}, fmt.Errorf("unsupported version %d", header[0])
+	}
+
+	userID, err := readSOCKS4String(reader)
+	if err != nil {
+		return socks4Request{}, fmt.Errorf("read user-ID: %w", err)
+	}
+
+	request := socks4Request{
+		command: header[1],
+		port:    binary.BigEndian.Uint16(header[2:4]),
+		host:    net.IP(header[4:8]).String(),
+		userID:  userID,
+	}
+	// SOCKS4a: 0.0.0.x with x != 0 means the hostname follows the user-ID.
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		host, err := readSOCKS4String(reader)
+		if err != nil {
+			return socks4Request{}, fmt.Errorf("read hostname: %w", err)
+		}
+		if host == "" {
+			return socks4Request{}, fmt.Errorf("empty hostname")
+		}
+		request.host = host
+	}
+	return request, nil
+}
+
+func readSOCKS4String(reader *bufio.Reader) (string, error) {
+	field := make([]byte, 0, 32)
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxFieldSize {
+			return "", fmt.Errorf("field longer than %d bytes", socks4MaxFieldSize)
+		}
+		field = append(field, b)
+	}
+}
+
+func writeSOCKS4Reply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{0x00, status, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSOCKS4Request(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		want    socks4Request
+	}{
+		{
+			name:    "socks4 ipv4",
+			request: []byte{socks4Version, socks4Connect, 0x00, 0x50, 93, 184, 216, 34, 'b', 'o', 'b', 0x00},
+			want:    socks4Request{command: socks4Connect, host: "93.184.216.34", port: 80, userID: "bob"},
+		},
+		{
+			name:    "socks4a hostname",
+			request: append([]byte{socks4Version, socks4Connect, 0x01, 0xbb, 0, 0, 0, 1, 0x00}, []byte("example.com\x00")...),
+			want:    socks4Request{command: socks4Connect, host: "example.com", port: 443},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readSOCKS4Request(bufio.NewReader(bytes.NewReader(tt.request)))
+			if err != nil {
+				t.Fatalf("readSOCKS4Request() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("readSOCKS4Request() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSOCKS4RequestErrors(t *testing.T) {
+	tests := map[string][]byte{
+		"invalid version":     {socks5Version, socks4Connect, 0, 80, 127, 0, 0, 1, 0},
+		"missing user-ID end": {socks4Version, socks4Connect, 0, 80, 127, 0, 0, 1, 'a'},
+		"empty hostname":      {socks4Version, socks4Connect, 0, 80, 0, 0, 0, 1, 0, 0},
+		"long user-ID":        append([]byte{socks4Version, socks4Connect, 0, 80, 127, 0, 0, 1}, []byte(strings.Repeat("a", 300)+"\x00")...),
+	}
+
+	for name, request := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := readSOCKS4Request(bufio.NewReader(bytes.NewReader(request))); err == nil {
+				t.Fatal("readSOCKS4Request() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestMixedProxyListenerRoutesSOCKS4a(t *testing.T) {
+	destConn, upstreamPeer := net.Pipe()
+	defer upstreamPeer.Close()
+
+	dialed := make(chan string, 1)
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return destConn, nil
+	}, func(sni string, destConn net.Conn, clientConn net.Conn) {
+		t.Error("SOCKS4 plain TCP should not use TLS MITM connect")
+	}, nil)
+
+	baseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener := newMixedProxyListener(baseListener, proxy, mixedListenerOptions{})
+	defer listener.Close()
+
+	conn, err := net.DialTimeout("tcp", baseListener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial mixed listener: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if err := upstreamPeer.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	request := append([]byte{socks4Version, socks4Connect, 0x00, 0x50, 0, 0, 0, 1}, []byte("legacy\x00example.com\x00")...)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatalf("write SOCKS4a request: %v", err)
+	}
+	readExact(t, conn, []byte{0x00, socks4Granted, 0, 0, 0, 0, 0, 0})
+	if addr := <-dialed; addr != "example.com:80" {
+		t.Fatalf("dial addr = %q, want example.com:80", addr)
+	}
+
+	if _, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	got := make([]byte, len("GET / HTTP/1.0\r\n\r\n"))
+	if _, err := io.ReadFull(upstreamPeer, got); err != nil {
+		t.Fatalf("upstream read: %v", err)
+	}
+	if string(got) != "GET / HTTP/1.0\r\n\r\n" {
+		t.Fatalf("upstream got %q", got)
+	}
+}
+
+func TestHandleSOCKS4RejectsWhenAuthRequired(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	if err := clientConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		t.Error("dial should not be called without authentication")
+		return nil, io.EOF
+	}, nil, nil)
+	proxy.users = &UserStore{}
+	go proxy.handleSOCKS4(serverConn)
+
+	if _, err := clientConn.Write([]byte{socks4Version, socks4Connect, 0, 80, 127, 0, 0, 1, 0}); err != nil {
+		t.Fatalf("write SOCKS4 request: %v", err)
+	}
+	readExact(t, clientConn, []byte{0x00, socks4Rejected, 0, 0, 0, 0, 0, 0})
+}
@@ -2,30 +2,39 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strconv"
-	"time"
 )
 
 const (
-	socks5Version      = 0x05
-	socks5NoAuth       = 0x00
-	socks5NoAcceptable = 0xff
-	socks5Connect      = 0x01
-	socks5Reserved     = 0x00
-	socks5IPv4         = 0x01
-	socks5Domain       = 0x03
-	socks5IPv6         = 0x04
-	socks5Succeeded    = 0x00
-	socks5GeneralFail  = 0x01
-	socks5CommandFail  = 0x07
-	socks5AddressFail  = 0x08
-	tlsHandshakeRecord = 0x16
-	socks5TLSPeekTime  = 100 * time.Millisecond
+	socks5Version         = 0x05
+	socks5NoAuth          = 0x00
+	socks5UserPass        = 0x02
+	socks5NoAcceptable    = 0xff
+	socks5Connect         = 0x01
+	socks5Bind            = 0x02
+	socks5UDPAssociate    = 0x03
+	socks5Reserved        = 0x00
+	socks5IPv4            = 0x01
+	socks5Domain          = 0x03
+	socks5IPv6            = 0x04
+	socks5Succeeded       = 0x00
+	socks5GeneralFail     = 0x01
+	socks5NotAllowed      = 0x02
+	socks5HostUnreachable = 0x04
+	socks5TTLExpired      = 0x06
+	socks5CommandFail     = 0x07
+	socks5AddressFail     = 0x08
+	socks5AuthVersion     = 0x01
+	socks5AuthSuccess     = 0x00
+	socks5AuthFailure     = 0x01
+	tlsHandshakeRecord    = 0x16
 )
 
 type socks5Request struct {
@@ -42,7 +51,8 @@ func (p *Proxy) handleSOCKS5(conn net.Conn) {
 	defer conn.Close()
 
 	reader := bufio.NewReader(conn)
-	if err := negotiateSOCKS5(conn, reader); err != nil {
+	ctx, err := p.negotiateSOCKS5(conn, reader)
+	if err != nil {
 		log.Printf("SOCKS5 negotiation error: %v", err)
 		return
 	}
@@ -53,6 +63,21 @@ func (p *Proxy) handleSOCKS5(conn net.Conn) {
 		log.Printf("SOCKS5 request error: %v", err)
 		return
 	}
+	// UDP ASSOCIATE and BIND bind to the address the client connected to and
+	// only accept the client's IP, which a unix socket does not have.
+	if (request.command == socks5UDPAssociate || request.command == socks5Bind) && (localIP(conn) == nil || remoteIP(conn) == nil) {
+		_ = writeSOCKS5Reply(conn, socks5CommandFail)
+		log.Printf("SOCKS5 command %d needs a TCP client connection", request.command)
+		return
+	}
+	if request.command == socks5UDPAssociate {
+		p.handleSOCKS5UDPAssociate(withUpstreamClient(ctx, conn.RemoteAddr().String()), conn, reader, request)
+		return
+	}
+	if request.command == socks5Bind {
+		p.handleSOCKS5Bind(conn, reader, request)
+		return
+	}
 	if request.command != socks5Connect {
 		_ = writeSOCKS5Reply(conn, socks5CommandFail)
 		log.Printf("SOCKS5 unsupported command: %d", request.command)
@@ -61,9 +86,9 @@ func (p *Proxy) handleSOCKS5(conn net.Conn) {
 
 	destAddr := request.addr()
 	log.Printf("socks5 proxy to %s", destAddr)
-	destConn, err := p.dial("tcp", destAddr)
+	destConn, err := p.dialFor(ctx, conn.RemoteAddr().String(), "tcp", destAddr)
 	if err != nil {
-		_ = writeSOCKS5Reply(conn, socks5GeneralFail)
+		_ = writeSOCKS5Reply(conn, socks5DialErrorReply(err))
 		log.Printf("SOCKS5 dial error: %v", err)
 		return
 	}
@@ -74,31 +99,87 @@ func (p *Proxy) handleSOCKS5(conn net.Conn) {
 		return
 	}
 
-	p.handleSOCKS5Tunnel(request.host, request.port, destConn, conn, reader)
+	p.handleSniffedTunnel(request.host, request.port, destConn, conn, reader)
 }
 
-func negotiateSOCKS5(conn net.Conn, reader *bufio.Reader) error {
+func (p *Proxy) negotiateSOCKS5(conn net.Conn, reader *bufio.Reader) (context.Context, error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(reader, header); err != nil {
-		return err
+		return nil, err
 	}
 	if header[0] != socks5Version {
-		return fmt.Errorf("unsupported version %d", header[0])
+		return nil, fmt.Errorf("unsupported version %d", header[0])
 	}
 
 	methods := make([]byte, int(header[1]))
 	if _, err := io.ReadFull(reader, methods); err != nil {
-		return err
+		return nil, err
+	}
+	// Session parameters arrive in the username, so ask for one even when
+	// no credentials are required.
+	wantMethod := byte(socks5NoAuth)
+	if p.users != nil || p.forwardsCredentials() || (p.sessions != nil && bytes.IndexByte(methods, socks5UserPass) >= 0) {
+		wantMethod = socks5UserPass
 	}
 	for _, method := range methods {
-		if method == socks5NoAuth {
-			_, err := conn.Write([]byte{socks5Version, socks5NoAuth})
-			return err
+		if method != wantMethod {
+			continue
 		}
+		if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+			return nil, err
+		}
+		if method == socks5UserPass {
+			return p.authenticateSOCKS5(conn, reader)
+		}
+		return context.Background(), nil
 	}
 
 	_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
-	return fmt.Errorf("no supported authentication method")
+	return nil, fmt.Errorf("no supported authentication method")
+}
+
+func (p *Proxy) authenticateSOCKS5(conn net.Conn, reader *bufio.Reader) (context.Context, error) {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != socks5AuthVersion {
+		return nil, fmt.Errorf("unsupported auth version %d", version)
+	}
+	user, err := readSOCKS5AuthField(reader)
+	if err != nil {
+		return nil, err
+	}
+	password, err := readSOCKS5AuthField(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.users.Authenticate(p.baseUser(user), password) {
+		_, _ = conn.Write([]byte{socks5AuthVersion, socks5AuthFailure})
+		return nil, fmt.Errorf("authentication failed for user %q", user)
+	}
+	ctx, err := p.clientContext(context.Background(), user, password)
+	if err != nil {
+		_, _ = conn.Write([]byte{socks5AuthVersion, socks5AuthFailure})
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{socks5AuthVersion, socks5AuthSuccess}); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func readSOCKS5AuthField(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	field := make([]byte, int(length))
+	if _, err := io.ReadFull(reader, field); err != nil {
+		return "", err
+	}
+	return string(field), nil
 }
 
 func readSOCKS5Request(reader *bufio.Reader) (socks5Request, error) {
@@ -174,43 +255,25 @@ func writeSOCKS5Reply(conn net.Conn, status byte) error {
 	return err
 }
 
-func (p *Proxy) handleSOCKS5Tunnel(host string, port uint16, destConn net.Conn, clientConn net.Conn, reader *bufio.Reader) {
-	if port == 443 {
-		p.connect(host, destConn, &bufferedReadConn{
-			Conn:   clientConn,
-			reader: reader,
-		})
-		return
-	}
+func writeSOCKS5ReplyAddr(conn net.Conn, status byte, host string, port uint16) error {
+	reply := []byte{socks5Version, status, socks5Reserved}
+	reply = appendSOCKS5Addr(reply, host, port)
+	_, err := conn.Write(reply)
+	return err
+}
 
-	if err := clientConn.SetReadDeadline(time.Now().Add(socks5TLSPeekTime)); err != nil {
-		destConn.Close()
-		log.Printf("SOCKS5 set read deadline error: %v", err)
-		return
-	}
-	first, err := reader.Peek(1)
-	if deadlineErr := clientConn.SetReadDeadline(time.Time{}); deadlineErr != nil {
-		destConn.Close()
-		log.Printf("SOCKS5 clear read deadline error: %v", deadlineErr)
-		return
-	}
-	if err != nil {
-		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
-			destConn.Close()
-			log.Printf("SOCKS5 client read error: %v", err)
-			return
+func appendSOCKS5Addr(buf []byte, host string, port uint16) []byte {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			buf = append(buf, socks5IPv4)
+			buf = append(buf, ip4...)
+		} else {
+			buf = append(buf, socks5IPv6)
+			buf = append(buf, ip.To16()...)
 		}
+	} else {
+		buf = append(buf, socks5Domain, byte(len(host)))
+		buf = append(buf, host...)
 	}
-
-	tunnelClientConn := &bufferedReadConn{
-		Conn:   clientConn,
-		reader: reader,
-	}
-	if len(first) > 0 && first[0] == tlsHandshakeRecord {
-		p.connect(host, destConn, tunnelClientConn)
-		return
-	}
-
-	defer destConn.Close()
-	junction(destConn, tunnelClientConn)
+	return binary.BigEndian.AppendUint16(buf, port)
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSOCKS5BindTimeout = 60 * time.Second
+
+type portRange struct {
+	first uint16
+	last  uint16
+}
+
+func parsePortRange(value string) (portRange, error) {
+	if value == "" {
+		return portRange{}, nil
+	}
+
+	firstText, lastText, isRange := strings.Cut(value, "-")
+	first, err := strconv.ParseUint(strings.TrimSpace(firstText), 10, 16)
+	if err != nil || first == 0 {
+		return portRange{}, fmt.Errorf("invalid port range %q", value)
+	}
+	last := first
+	if isRange {
+		last, err = strconv.ParseUint(strings.TrimSpace(lastText), 10, 16)
+		if err != nil || last < first {
+			return portRange{}, fmt.Errorf("invalid port range %q", value)
+		}
+	}
+	return portRange{first: uint16(first), last: uint16(last)}, nil
+}
+
+func (ports portRange) listen(ip net.IP) (*net.TCPListener, error) {
+	if ports.first == 0 {
+		return net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	}
+
+	size := int(ports.last-ports.first) + 1
+	offset := rand.IntN(size)
+	var lastErr error
+	for i := 0; i < size; i++ {
+		port := int(ports.first) + (offset+i)%size
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return listener, nil
+		}
+		lastErr = err
+	}
+	return nil, fmt.Errorf("no free port in %d-%d: %w", ports.first, ports.last, lastErr)
+}
+
+func (p *Proxy) bindTimeout() time.Duration {
+	if p != nil && p.socks5BindTimeout > 0 {
+		return p.socks5BindTimeout
+	}
+	return defaultSOCKS5BindTimeout
+}
+
+func (p *Proxy) handleSOCKS5Bind(conn net.Conn, reader *bufio.Reader, request socks5Request) {
+	// The bound port would be opened on this host, so with an upstream proxy
+	// BIND would expose the address the upstream is meant to hide.
+	if p != nil && p.socks5BindDisabled {
+		_ = writeSOCKS5Reply(conn, socks5NotAllowed)
+		log.Printf("SOCKS5 bind refused for %s: not supported through an upstream proxy", request.addr())
+		return
+	}
+	var ports portRange
+	if p != nil {
+		ports = p.socks5BindPorts
+	}
+	listener, err := ports.listen(localIP(conn))
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5GeneralFail)
+		log.Printf("SOCKS5 bind listen error: %v", err)
+		return
+	}
+	defer listener.Close()
+
+	boundAddr := listener.Addr().(*net.TCPAddr)
+	if err := writeSOCKS5ReplyAddr(conn, socks5Succeeded, boundAddr.IP.String(), uint16(boundAddr.Port)); err != nil {
+		log.Printf("SOCKS5 reply error: %v", err)
+		return
+	}
+	log.Printf("socks5 bind at %s for %s", boundAddr, request.addr())
+
+	stopWatch := watchSOCKS5BindControl(conn, reader, listener)
+	peerConn, err := acceptSOCKS5BindPeer(listener, request, p.bindTimeout())
+	stopWatch()
+	if err != nil {
+		status := byte(socks5GeneralFail)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			status = socks5TTLExpired
+		}
+		_ = writeSOCKS5Reply(conn, status)
+		log.Printf("SOCKS5 bind accept error: %v", err)
+		return
+	}
+	listener.Close()
+
+	peerAddr := peerConn.RemoteAddr().(*net.TCPAddr)
+	if err := writeSOCKS5ReplyAddr(conn, socks5Succeeded, peerAddr.IP.String(), uint16(peerAddr.Port)); err != nil {
+		peerConn.Close()
+		log.Printf("SOCKS5 reply error: %v", err)
+		return
+	}
+
+	defer peerConn.Close()
+	junction(peerConn, &bufferedReadConn{
+		Conn:   conn,
+		reader: reader,
+	})
+}
+
+// watchSOCKS5BindControl closes listener when the client hangs up while BIND
+// waits for its peer, so the port is released right away. The returned func
+// stops watching and leaves anything the client sent buffered in reader.
+func watchSOCKS5BindControl(conn net.Conn, reader *bufio.Reader, listener *net.TCPListener) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			listener.Close()
+		}
+	}()
+	return func() {
+		_ = conn.SetReadDeadline(time.Now())
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func acceptSOCKS5BindPeer(listener *net.TCPListener, request socks5Request, timeout time.Duration) (*net.TCPConn, error) {
+	if err := listener.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	expected := net.ParseIP(request.host)
+	if expected != nil && expected.IsUnspecified() {
+		expected = nil
+	}
+	for {
+		peerConn, err := listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		peerIP := peerConn.RemoteAddr().(*net.TCPAddr).IP
+		if expected == nil || expected.Equal(peerIP) {
+			return peerConn, nil
+		}
+		log.Printf("SOCKS5 bind rejected peer %s, want %s", peerIP, expected)
+		peerConn.Close()
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    portRange
+		wantErr bool
+	}{
+		{in: "", want: portRange{}},
+		{in: "40000", want: portRange{first: 40000, last: 40000}},
+		{in: "40000-40100", want: portRange{first: 40000, last: 40100}},
+		{in: "40100-40000", wantErr: true},
+		{in: "0-10", wantErr: true},
+		{in: "70000", wantErr: true},
+		{in: "a-b", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parsePortRange(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Fatalf("parsePortRange(%q) error = nil, want error", tt.in)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("parsePortRange(%q) error = %v", tt.in, err)
+		}
+		if got != tt.want {
+			t.Fatalf("parsePortRange(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHandleSOCKS5BindRelaysInboundConnection(t *testing.T) {
+	proxyAddr := newSOCKS5TestServer(t, NewProxy(nil, nil, nil))
+	control, reader := socks5TestBind(t, proxyAddr, "127.0.0.1")
+	defer control.Close()
+
+	host, port := readSOCKS5TestReplyAddr(t, reader, socks5Succeeded)
+	peer, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial bound address: %v", err)
+	}
+	defer peer.Close()
+	if err := peer.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	peerHost, peerPort := readSOCKS5TestReplyAddr(t, reader, socks5Succeeded)
+	localAddr := peer.LocalAddr().(*net.TCPAddr)
+	if peerHost != localAddr.IP.String() || int(peerPort) != localAddr.Port {
+		t.Fatalf("second reply peer = %s:%d, want %s", peerHost, peerPort, localAddr)
+	}
+
+	if _, err := peer.Write([]byte("from peer")); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+	got := make([]byte, len("from peer"))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if string(got) != "from peer" {
+		t.Fatalf("client got %q, want from peer", got)
+	}
+
+	if _, err := control.Write([]byte("from client")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	readExact(t, peer, []byte("from client"))
+}
+
+func TestHandleSOCKS5BindUsesPortRangeAndTimeout(t *testing.T) {
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	freePort := uint16(probe.Addr().(*net.TCPAddr).Port)
+	probe.Close()
+
+	proxy := NewProxy(nil, nil, nil)
+	proxy.socks5BindPorts = portRange{first: freePort, last: freePort}
+	proxy.socks5BindTimeout = 50 * time.Millisecond
+	proxyAddr := newSOCKS5TestServer(t, proxy)
+
+	control, reader := socks5TestBind(t, proxyAddr, "0.0.0.0")
+	defer control.Close()
+
+	_, port := readSOCKS5TestReplyAddr(t, reader, socks5Succeeded)
+	if port != freePort {
+		t.Fatalf("bound port = %d, want %d", port, freePort)
+	}
+	readSOCKS5TestReplyAddr(t, reader, socks5TTLExpired)
+}
+
+func TestHandleSOCKS5BindReleasesPortWhenClientLeaves(t *testing.T) {
+	proxy := NewProxy(nil, nil, nil)
+	proxy.socks5BindTimeout = time.Minute
+	proxyAddr := newSOCKS5TestServer(t, proxy)
+
+	// Probes from 127.0.0.1 are not the expected peer, so only the client
+	// leaving can end the BIND.
+	control, reader := socks5TestBind(t, proxyAddr, "192.0.2.1")
+	host, port := readSOCKS5TestReplyAddr(t, reader, socks5Succeeded)
+	control.Close()
+
+	boundAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.DialTimeout("tcp", boundAddr, time.Second)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("bound port still accepts connections after the client left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleSOCKS5BindRefusedWithUpstream(t *testing.T) {
+	proxy := NewProxy(nil, nil, nil)
+	proxy.socks5BindDisabled = true
+	proxyAddr := newSOCKS5TestServer(t, proxy)
+
+	control, reader := socks5TestBind(t, proxyAddr, "127.0.0.1")
+	defer control.Close()
+	readSOCKS5TestReplyAddr(t, reader, socks5NotAllowed)
+}
+
+func socks5TestBind(t *testing.T, proxyAddr string, peerHost string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	control, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	if err := control.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	writeSOCKS5Greeting(t, control, socks5NoAuth)
+	readExact(t, control, []byte{socks5Version, socks5NoAuth})
+	writeSOCKS5Request(t, control, socks5Bind, socks5Reserved, socks5IPv4, net.ParseIP(peerHost).To4(), 0)
+	return control, bufio.NewReader(control)
+}
+
+func readSOCKS5TestReplyAddr(t *testing.T, reader *bufio.Reader, wantStatus byte) (string, uint16) {
+	t.Helper()
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if header[1] != wantStatus {
+		t.Fatalf("reply status = %d, want %d", header[1], wantStatus)
+	}
+	host, err := readSOCKS5Address(reader, header[3])
+	if err != nil {
+		t.Fatalf("read reply address: %v", err)
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		t.Fatalf("read reply port: %v", err)
+	}
+	return host, binary.BigEndian.Uint16(portBytes)
+}
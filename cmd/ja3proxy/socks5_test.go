@@ -174,10 +174,31 @@ func TestHandleSOCKS5RejectsUnsupportedCommand(t *testing.T) {
 
 	writeSOCKS5Greeting(t, clientConn, socks5NoAuth)
 	readExact(t, clientConn, []byte{socks5Version, socks5NoAuth})
-	writeSOCKS5Request(t, clientConn, 0x02, socks5Reserved, socks5Domain, []byte("example.com"), 80)
+	writeSOCKS5Request(t, clientConn, 0x09, socks5Reserved, socks5Domain, []byte("example.com"), 80)
 	readExact(t, clientConn, []byte{socks5Version, socks5CommandFail, socks5Reserved, socks5IPv4, 0, 0, 0, 0, 0, 0})
 }
 
+func TestHandleSOCKS5RejectsUDPAssociateAndBindWithoutTCPClient(t *testing.T) {
+	for _, command := range []byte{socks5UDPAssociate, socks5Bind} {
+		clientConn, serverConn := net.Pipe()
+		if err := clientConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			t.Fatalf("set client deadline: %v", err)
+		}
+
+		proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+			t.Fatalf("dial should not be called for command %d", command)
+			return nil, nil
+		}, nil, nil)
+		go proxy.handleSOCKS5(serverConn)
+
+		writeSOCKS5Greeting(t, clientConn, socks5NoAuth)
+		readExact(t, clientConn, []byte{socks5Version, socks5NoAuth})
+		writeSOCKS5Request(t, clientConn, command, socks5Reserved, socks5IPv4, []byte{0, 0, 0, 0}, 0)
+		readExact(t, clientConn, []byte{socks5Version, socks5CommandFail, socks5Reserved, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		clientConn.Close()
+	}
+}
+
 func TestHandleSOCKS5RejectsInvalidRequestHeader(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -414,7 +435,7 @@ func TestMixedProxyListenerRoutesHTTPToServer(t *testing.T) {
 		Handler: proxy,
 	}
 	go func() {
-		_ = server.Serve(newMixedProxyListener(baseListener, proxy))
+		_ = server.Serve(newMixedProxyListener(baseListener, proxy, mixedListenerOptions{}))
 	}()
 	t.Cleanup(func() {
 		_ = server.Close()
@@ -460,7 +481,7 @@ func TestMixedProxyListenerAddrAndClose(t *testing.T) {
 		t.Fatalf("listen: %v", err)
 	}
 
-	listener := newMixedProxyListener(baseListener, NewProxy(nil, nil, nil))
+	listener := newMixedProxyListener(baseListener, NewProxy(nil, nil, nil), mixedListenerOptions{})
 	if listener.Addr().String() != baseListener.Addr().String() {
 		t.Fatalf("Addr() = %q, want %q", listener.Addr().String(), baseListener.Addr().String())
 	}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5UDPHeaderLen  = 3
+	socks5UDPBufferSize = 64 * 1024
+)
+
+type socks5UDPDatagram struct {
+	host    string
+	port    uint16
+	payload []byte
+}
+
+func (datagram socks5UDPDatagram) addr() string {
+	return net.JoinHostPort(datagram.host, strconv.Itoa(int(datagram.port)))
+}
+
+func parseSOCKS5UDPDatagram(packet []byte) (socks5UDPDatagram, error) {
+	if len(packet) < socks5UDPHeaderLen+1 {
+		return socks5UDPDatagram{}, fmt.Errorf("short datagram")
+	}
+	if packet[0] != 0 || packet[1] != 0 {
+		return socks5UDPDatagram{}, fmt.Errorf("reserved bytes = %d %d", packet[0], packet[1])
+	}
+	if packet[2] != 0 {
+		return socks5UDPDatagram{}, fmt.Errorf("fragmented datagram %d is not supported", packet[2])
+	}
+
+	rest := packet[socks5UDPHeaderLen+1:]
+	var host string
+	switch packet[socks5UDPHeaderLen] {
+	case socks5IPv4:
+		if len(rest) < net.IPv4len {
+			return socks5UDPDatagram{}, fmt.Errorf("short IPv4 address")
+		}
+		host = net.IP(rest[:net.IPv4len]).String()
+		rest = rest[net.IPv4len:]
+	case socks5Domain:
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) || rest[0] == 0 {
+			return socks5UDPDatagram{}, fmt.Errorf("invalid domain")
+		}
+		host = string(rest[1 : 1+int(rest[0])])
+		rest = rest[1+int(rest[0]):]
+	case socks5IPv6:
+		if len(rest) < net.IPv6len {
+			return socks5UDPDatagram{}, fmt.Errorf("short IPv6 address")
+		}
+		host = net.IP(rest[:net.IPv6len]).String()
+		rest = rest[net.IPv6len:]
+	default:
+		return socks5UDPDatagram{}, fmt.Errorf("unsupported address type %d", packet[socks5UDPHeaderLen])
+	}
+	if len(rest) < 2 {
+		return socks5UDPDatagram{}, fmt.Errorf("short port")
+	}
+
+	return socks5UDPDatagram{
+		host:    host,
+		port:    binary.BigEndian.Uint16(rest[:2]),
+		payload: rest[2:],
+	}, nil
+}
+
+func buildSOCKS5UDPDatagram(host string, port uint16, payload []byte) []byte {
+	packet := make([]byte, socks5UDPHeaderLen, socks5UDPHeaderLen+1+net.IPv6len+2+len(payload))
+	packet = appendSOCKS5Addr(packet, host, port)
+	return append(packet, payload...)
+}
+
+// udpEgress sends client datagrams to their destination and returns replies
+// already wrapped in a SOCKS5 UDP header for the client.
+type udpEgress interface {
+	Send(packet []byte, datagram socks5UDPDatagram) error
+	Receive(buf []byte) ([]byte, error)
+	Close() error
+}
+
+type directUDPEgress struct {
+	conn *net.UDPConn
+}
+
+func newDirectUDPEgress() (udpEgress, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	return &directUDPEgress{conn: conn}, nil
+}
+
+func (egress *directUDPEgress) Send(_ []byte, datagram socks5UDPDatagram) error {
+	addr, err := net.ResolveUDPAddr("udp", datagram.addr())
+	if err != nil {
+		return err
+	}
+	_, err = egress.conn.WriteToUDP(datagram.payload, addr)
+	return err
+}
+
+func (egress *directUDPEgress) Receive(buf []byte) ([]byte, error) {
+	n, addr, err := egress.conn.ReadFromUDP(buf)
+	if err != nil {
+		return nil, err
+	}
+	host := addr.IP.String()
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		host = ip4.String()
+	}
+	return buildSOCKS5UDPDatagram(host, uint16(addr.Port), buf[:n]), nil
+}
+
+func (egress *directUDPEgress) Close() error {
+	return egress.conn.Close()
+}
+
+type socks5UDPEgress struct {
+	control net.Conn
+	relay   *net.UDPConn
+}
+
+func newSOCKS5UDPEgress(proxyURL *url.URL, timeout time.Duration) (udpEgress, error) {
+	control, err := net.DialTimeout("tcp", proxyURL.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := control.SetDeadline(time.Now().Add(timeout)); err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(control)
+	relayHost, relayPort, err := socks5ClientUDPAssociate(control, reader, proxyURL.User)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("upstream UDP associate: %w", err)
+	}
+	if err := control.SetDeadline(time.Time{}); err != nil {
+		control.Close()
+		return nil, err
+	}
+	if ip := net.ParseIP(relayHost); ip == nil || ip.IsUnspecified() {
+		relayHost = stripPort(proxyURL.Host)
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(relayHost, strconv.Itoa(int(relayPort))))
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+	relay, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	return &socks5UDPEgress{control: control, relay: relay}, nil
+}
+
+func socks5ClientUDPAssociate(conn net.Conn, reader *bufio.Reader, user *url.Userinfo) (string, uint16, error) {
+	methods := []byte{socks5NoAuth}
+	if user != nil {
+		methods = []byte{socks5NoAuth, socks5UserPass}
+	}
+	greeting := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return "", 0, err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(reader, reply); err != nil {
+		return "", 0, err
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if user == nil {
+			return "", 0, fmt.Errorf("proxy requires authentication")
+		}
+		password, _ := user.Password()
+		request := []byte{socks5AuthVersion, byte(len(user.Username()))}
+		request = append(request, user.Username()...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return "", 0, err
+		}
+		if _, err := io.ReadFull(reader, reply); err != nil {
+			return "", 0, err
+		}
+		if reply[1] != socks5AuthSuccess {
+			return "", 0, fmt.Errorf("authentication failed")
+		}
+	default:
+		return "", 0, fmt.Errorf("no acceptable authentication method")
+	}
+
+	request := []byte{socks5Version, socks5UDPAssociate, socks5Reserved}
+	request = appendSOCKS5Addr(request, "0.0.0.0", 0)
+	if _, err := conn.Write(request); err != nil {
+		return "", 0, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", 0, err
+	}
+	if header[1] != socks5Succeeded {
+		return "", 0, fmt.Errorf("reply status %d", header[1])
+	}
+	host, err := readSOCKS5Address(reader, header[3])
+	if err != nil {
+		return "", 0, err
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(reader, portBytes); err != nil {
+		return "", 0, err
+	}
+	return host, binary.BigEndian.Uint16(portBytes), nil
+}
+
+func (egress *socks5UDPEgress) Send(packet []byte, _ socks5UDPDatagram) error {
+	_, err := egress.relay.Write(packet)
+	return err
+}
+
+func (egress *socks5UDPEgress) Receive(buf []byte) ([]byte, error) {
+	n, err := egress.relay.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+func (egress *socks5UDPEgress) Close() error {
+	err := egress.relay.Close()
+	if closeErr := egress.control.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (p *Proxy) listenUDPEgress(ctx context.Context) (udpEgress, error) {
+	if p != nil && p.udpEgress != nil {
+		return p.udpEgress(ctx)
+	}
+	return newDirectUDPEgress()
+}
+
+func (p *Proxy) handleSOCKS5UDPAssociate(ctx context.Context, conn net.Conn, reader *bufio.Reader, request socks5Request) {
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP(conn)})
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5GeneralFail)
+		log.Printf("SOCKS5 UDP listen error: %v", err)
+		return
+	}
+	defer relayConn.Close()
+
+	egress, err := p.listenUDPEgress(ctx)
+	if err != nil {
+		_ = writeSOCKS5Reply(conn, socks5GeneralFail)
+		log.Printf("SOCKS5 UDP egress error: %v", err)
+		return
+	}
+	defer egress.Close()
+
+	relayAddr := relayConn.LocalAddr().(*net.UDPAddr)
+	if err := writeSOCKS5ReplyAddr(conn, socks5Succeeded, relayAddr.IP.String(), uint16(relayAddr.Port)); err != nil {
+		log.Printf("SOCKS5 reply error: %v", err)
+		return
+	}
+	log.Printf("socks5 UDP associate for %s at %s", conn.RemoteAddr(), relayAddr)
+
+	relay := &socks5UDPRelay{
+		conn:       relayConn,
+		egress:     egress,
+		clientIP:   remoteIP(conn),
+		clientPort: request.port,
+		clientAddr: make(chan *net.UDPAddr, 1),
+		done:       make(chan struct{}),
+	}
+	defer close(relay.done)
+	if ip := net.ParseIP(request.host); ip != nil && !ip.IsUnspecified() {
+		relay.clientIP = ip
+	}
+	go relay.serveClient()
+	go relay.serveEgress()
+
+	// The association lives as long as the TCP control connection.
+	_, _ = io.Copy(io.Discard, reader)
+}
+
+type socks5UDPRelay struct {
+	conn       *net.UDPConn
+	egress     udpEgress
+	clientIP   net.IP
+	clientPort uint16
+	clientAddr chan *net.UDPAddr
+	done       chan struct{}
+}
+
+func (relay *socks5UDPRelay) acceptsClient(addr *net.UDPAddr) bool {
+	if relay.clientIP != nil && !relay.clientIP.Equal(addr.IP) {
+		return false
+	}
+	return relay.clientPort == 0 || relay.clientPort == uint16(addr.Port)
+}
+
+func (relay *socks5UDPRelay) serveClient() {
+	var clientAddr *net.UDPAddr
+	buf := make([]byte, socks5UDPBufferSize)
+	for {
+		n, addr, err := relay.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("SOCKS5 UDP client read error: %v", err)
+			}
+			return
+		}
+		if !relay.acceptsClient(addr) {
+			continue
+		}
+		if clientAddr == nil {
+			clientAddr = addr
+			relay.clientAddr <- addr
+		} else if !clientAddr.IP.Equal(addr.IP) || clientAddr.Port != addr.Port {
+			continue
+		}
+
+		packet := buf[:n]
+		datagram, err := parseSOCKS5UDPDatagram(packet)
+		if err != nil {
+			log.Printf("SOCKS5 UDP dropped datagram from %s: %v", addr, err)
+			continue
+		}
+		if err := relay.egress.Send(packet, datagram); err != nil {
+			log.Printf("SOCKS5 UDP send to %s error: %v", datagram.addr(), err)
+		}
+	}
+}
+
+func (relay *socks5UDPRelay) serveEgress() {
+	buf := make([]byte, socks5UDPBufferSize)
+	var clientAddr *net.UDPAddr
+	for {
+		packet, err := relay.egress.Receive(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("SOCKS5 UDP egress read error: %v", err)
+			}
+			return
+		}
+		if clientAddr == nil {
+			select {
+			case clientAddr = <-relay.clientAddr:
+			case <-relay.done:
+				return
+			}
+		}
+		if _, err := relay.conn.WriteToUDP(packet, clientAddr); err != nil {
+			log.Printf("SOCKS5 UDP client write error: %v", err)
+		}
+	}
+}
+
+func localIP(conn net.Conn) net.IP {
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
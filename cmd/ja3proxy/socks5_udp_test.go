@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseSOCKS5UDPDatagram(t *testing.T) {
+	packet := buildSOCKS5UDPDatagram("example.com", 53, []byte("query"))
+	datagram, err := parseSOCKS5UDPDatagram(packet)
+	if err != nil {
+		t.Fatalf("parseSOCKS5UDPDatagram() error = %v", err)
+	}
+	if datagram.addr() != "example.com:53" {
+		t.Fatalf("datagram addr = %q, want example.com:53", datagram.addr())
+	}
+	if string(datagram.payload) != "query" {
+		t.Fatalf("datagram payload = %q, want query", datagram.payload)
+	}
+
+	packet = buildSOCKS5UDPDatagram("2001:db8::1", 443, []byte("quic"))
+	datagram, err = parseSOCKS5UDPDatagram(packet)
+	if err != nil {
+		t.Fatalf("parseSOCKS5UDPDatagram(ipv6) error = %v", err)
+	}
+	if datagram.addr() != "[2001:db8::1]:443" {
+		t.Fatalf("datagram addr = %q, want [2001:db8::1]:443", datagram.addr())
+	}
+
+	fragmented := buildSOCKS5UDPDatagram("127.0.0.1", 53, []byte("part"))
+	fragmented[2] = 1
+	invalid := map[string][]byte{
+		"fragment":     fragmented,
+		"reserved":     append([]byte{1}, packet[1:]...),
+		"short":        {0, 0, 0},
+		"address type": {0, 0, 0, 0x09, 1, 2},
+		"short port":   {0, 0, 0, socks5IPv4, 127, 0, 0, 1, 0},
+	}
+	for name, packet := range invalid {
+		if _, err := parseSOCKS5UDPDatagram(packet); err == nil {
+			t.Fatalf("parseSOCKS5UDPDatagram(%s) error = nil, want error", name)
+		}
+	}
+}
+
+func TestHandleSOCKS5UDPAssociateRelaysDatagrams(t *testing.T) {
+	echoAddr := newUDPEchoServer(t)
+	proxyAddr := newSOCKS5TestServer(t, NewProxy(nil, nil, nil))
+
+	control, relayAddr := socks5TestUDPAssociate(t, proxyAddr)
+	defer control.Close()
+
+	assertUDPEcho(t, relayAddr, echoAddr)
+}
+
+func TestHandleSOCKS5UDPAssociateThroughUpstreamSOCKS5(t *testing.T) {
+	echoAddr := newUDPEchoServer(t)
+	upstreamAddr := newSOCKS5TestServer(t, NewProxy(nil, nil, nil))
+
+	proxy := NewProxy(nil, nil, nil)
+	proxy.udpEgress = func(context.Context) (udpEgress, error) {
+		return newSOCKS5UDPEgress(&url.URL{Scheme: "socks5", Host: upstreamAddr}, 2*time.Second)
+	}
+	proxyAddr := newSOCKS5TestServer(t, proxy)
+
+	control, relayAddr := socks5TestUDPAssociate(t, proxyAddr)
+	defer control.Close()
+
+	assertUDPEcho(t, relayAddr, echoAddr)
+}
+
+func TestHandleSOCKS5UDPAssociateClosesWithControlConnection(t *testing.T) {
+	proxyAddr := newSOCKS5TestServer(t, NewProxy(nil, nil, nil))
+
+	control, relayAddr := socks5TestUDPAssociate(t, proxyAddr)
+	control.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		probe, err := net.ListenUDP("udp", relayAddr)
+		if err == nil {
+			probe.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("UDP relay socket was not released after the control connection closed")
+}
+
+func newSOCKS5TestServer(t *testing.T, proxy *Proxy) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go proxy.handleSOCKS5(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newUDPEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen UDP: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(append([]byte("echo:"), buf[:n]...), addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func socks5TestUDPAssociate(t *testing.T, proxyAddr string) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+
+	control, err := net.DialTimeout("tcp", proxyAddr, 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	if err := control.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	writeSOCKS5Greeting(t, control, socks5NoAuth)
+	readExact(t, control, []byte{socks5Version, socks5NoAuth})
+	writeSOCKS5Request(t, control, socks5UDPAssociate, socks5Reserved, socks5IPv4, []byte{0, 0, 0, 0}, 0)
+
+	host, port := readSOCKS5TestReplyAddr(t, bufio.NewReader(control), socks5Succeeded)
+	if err := control.SetDeadline(time.Time{}); err != nil {
+		t.Fatalf("clear deadline: %v", err)
+	}
+
+	relayAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatalf("resolve relay: %v", err)
+	}
+	return control, relayAddr
+}
+
+func assertUDPEcho(t *testing.T, relayAddr *net.UDPAddr, echoAddr *net.UDPAddr) {
+	t.Helper()
+
+	client, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		t.Fatalf("dial relay: %v", err)
+	}
+	defer client.Close()
+	if err := client.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+
+	packet := buildSOCKS5UDPDatagram(echoAddr.IP.String(), uint16(echoAddr.Port), []byte("ping"))
+	if _, err := client.Write(packet); err != nil {
+		t.Fatalf("write datagram: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("read datagram: %v", err)
+	}
+	want := buildSOCKS5UDPDatagram(echoAddr.IP.String(), uint16(echoAddr.Port), []byte("echo:ping"))
+	if !bytes.Equal(buf[:n], want) {
+		t.Fatalf("reply datagram = %v, want %v", buf[:n], want)
+	}
+}
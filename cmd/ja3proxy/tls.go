@@ -13,6 +13,8 @@ type TunnelHandler struct {
 	Debug             bool
 	CA                *CertificateAuthority
 	SessionKey        *SessionKeyHelper
+	LeafKeys          *LeafKeyStore
+	CertOverrides     *CertOverrideStore
 	TLSFingerprints   *TLSFingerprintStore
 	DefaultTLSClient  string
 	DefaultTLSVersion string
@@ -39,6 +41,9 @@ func (handler *TunnelHandler) configuredTLSFingerprint() TLSFingerprint {
 
 func (handler *TunnelHandler) customTLSWrap(conn net.Conn, sni string, nextProtos []string) (*utls.UConn, error) {
 	fingerprint := handler.configuredTLSFingerprint()
+	if session := connSession(conn); session != nil && session.fingerprint != nil {
+		fingerprint = *session.fingerprint
+	}
 	clientHelloID := utls.ClientHelloID{
 		Client: fingerprint.Client, Version: fingerprint.Version, Seed: nil, Weights: nil,
 	}
@@ -48,27 +53,35 @@ func (handler *TunnelHandler) customTLSWrap(conn net.Conn, sni string, nextProto
 		InsecureSkipVerify: true,
 		NextProtos:         nextProtos,
 	}
+	uTLSConn, err := newUTLSClient(conn, tlsConfig, clientHelloID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := uTLSConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	return uTLSConn, nil
+}
+
+func newUTLSClient(conn net.Conn, tlsConfig *utls.Config, clientHelloID utls.ClientHelloID) (*utls.UConn, error) {
 	uTLSConn := utls.UClient(
 		conn,
 		tlsConfig,
 		clientHelloID,
 	)
 
-	if len(nextProtos) > 0 && clientHelloID.Client != utls.HelloGolang.Client {
+	if len(tlsConfig.NextProtos) > 0 && clientHelloID.Client != utls.HelloGolang.Client {
 		spec, err := utls.UTLSIdToSpec(clientHelloID)
 		if err == nil {
-			limitSpecALPN(&spec, nextProtos)
+			limitSpecALPN(&spec, tlsConfig.NextProtos)
 			uTLSConn = utls.UClient(conn, tlsConfig, utls.HelloCustom)
 			if err := uTLSConn.ApplyPreset(&spec); err != nil {
 				return nil, err
 			}
 		}
 	}
-
-	if err := uTLSConn.Handshake(); err != nil {
-		return nil, err
-	}
-
 	return uTLSConn, nil
 }
 
@@ -119,10 +132,31 @@ func clientALPN(upstreamProtocol string) []string {
 	return []string{"http/1.1"}
 }
 
+func (handler *TunnelHandler) certificateForClient(sni string, hello *tls.ClientHelloInfo) (tls.Certificate, error) {
+	if handler != nil {
+		if cert, ok := handler.CertOverrides.Lookup(sni); ok {
+			return cert, nil
+		}
+	}
+	return handler.generateCertificateForClient(sni, hello)
+}
+
 func (handler *TunnelHandler) generateCertificate(sni string) (tls.Certificate, error) {
+	return handler.generateCertificateForClient(sni, nil)
+}
+
+func (handler *TunnelHandler) generateCertificateForClient(sni string, hello *tls.ClientHelloInfo) (tls.Certificate, error) {
 	if handler == nil || handler.CA == nil {
 		return tls.Certificate{}, fmt.Errorf("CA certificate has not been loaded")
 	}
+
+	if handler.LeafKeys != nil {
+		session, err := handler.LeafKeys.Get(sni, leafKeyTypeForClient(hello))
+		if err != nil {
+			return tls.Certificate{}, fmt.Errorf("leaf key: %w", err)
+		}
+		return handler.CA.GenerateCertificate(session, sni)
+	}
 	if handler.SessionKey == nil {
 		return tls.Certificate{}, fmt.Errorf("session key has not been generated")
 	}
@@ -143,7 +177,7 @@ func (handler *TunnelHandler) Connect(sni string, destConn net.Conn, clientConn
 				serverName = hello.ServerName
 			}
 
-			tlsCert, err := handler.generateCertificate(serverName)
+			tlsCert, err := handler.certificateForClient(serverName, hello)
 			if err != nil {
 				return nil, fmt.Errorf("generate certificate: %w", err)
 			}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"log"
+	"net"
+)
+
+var errNotRedirected = errors.New("connection was not redirected")
+
+func (p *Proxy) serveTransparent(listener net.Listener, tproxy bool) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			dst, err := originalDestination(conn, tproxy)
+			if err != nil {
+				conn.Close()
+				log.Printf("transparent original destination for %s: %v", conn.RemoteAddr(), err)
+				return
+			}
+			p.handleTransparent(conn, dst)
+		}()
+	}
+}
+
+func (p *Proxy) handleTransparent(conn net.Conn, dst *net.TCPAddr) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, clientHelloReaderSize)
+	isTLS, err := sniffTLS(conn, reader)
+	if err != nil {
+		log.Printf("transparent client read error: %v", err)
+		return
+	}
+
+	host := dst.IP.String()
+	if isTLS {
+		if sni, err := readClientHelloSNI(conn, reader); err != nil {
+			log.Printf("transparent ClientHello from %s: %v", conn.RemoteAddr(), err)
+		} else if sni != "" {
+			host = sni
+		}
+	}
+
+	log.Printf("transparent proxy to %s (%s)", dst, host)
+	destConn, err := p.dialFor(context.Background(), conn.RemoteAddr().String(), "tcp", dst.String())
+	if err != nil {
+		log.Printf("transparent dial error: %v", err)
+		return
+	}
+
+	clientConn := &bufferedReadConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	if isTLS {
+		p.connect(host, destConn, clientConn)
+		return
+	}
+
+	defer destConn.Close()
+	junction(destConn, clientConn)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// IP6T_SO_ORIGINAL_DST from linux/netfilter_ipv6/ip6_tables.h.
+const ip6tSOOriginalDst = 80
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	config := net.ListenConfig{}
+	if tproxy {
+		config.Control = func(network, address string, rawConn syscall.RawConn) error {
+			var sockErr error
+			err := rawConn.Control(func(fd uintptr) {
+				// A tcp6 listener on an unspecified address is dual-stack and
+				// also takes TPROXY'd IPv4 connections.
+				if network == "tcp6" {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+				if sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("enable transparent socket (requires CAP_NET_ADMIN): %w", sockErr)
+			}
+			return nil
+		}
+	}
+	return config.Listen(context.Background(), "tcp", addr)
+}
+
+func originalDestination(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("unsupported local address %s", conn.LocalAddr())
+	}
+	if tproxy {
+		return local, nil
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("unsupported connection type %T", conn)
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		dst, sockErr = getsockoptOriginalDst(int(fd), local.IP.To4() == nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %w", sockErr)
+	}
+	if dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		return nil, errNotRedirected
+	}
+	return dst, nil
+}
+
+func getsockoptOriginalDst(fd int, ipv6 bool) (*net.TCPAddr, error) {
+	if ipv6 {
+		info, err := unix.GetsockoptIPv6MTUInfo(fd, unix.SOL_IPV6, ip6tSOOriginalDst)
+		if err != nil {
+			return nil, err
+		}
+		port := make([]byte, 2)
+		binary.NativeEndian.PutUint16(port, info.Addr.Port)
+		return &net.TCPAddr{
+			IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+			Port: int(binary.BigEndian.Uint16(port)),
+		}, nil
+	}
+
+	// The kernel writes a sockaddr_in into the 16-byte ip_mreq buffer.
+	mreq, err := unix.GetsockoptIPv6Mreq(fd, unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	if err != nil {
+		return nil, err
+	}
+	addr := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(addr[4], addr[5], addr[6], addr[7]),
+		Port: int(binary.BigEndian.Uint16(addr[2:4])),
+	}, nil
+}
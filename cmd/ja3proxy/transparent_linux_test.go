@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListenTransparentDualStackSetsBothOptions(t *testing.T) {
+	listener, err := listenTransparent("[::]:0", true)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("TPROXY sockets need CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatalf("listenTransparent() error = %v", err)
+	}
+	defer listener.Close()
+
+	rawConn, err := listener.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() error = %v", err)
+	}
+	var ipv4, ipv6 int
+	var ipv4Err, ipv6Err error
+	if err := rawConn.Control(func(fd uintptr) {
+		ipv4, ipv4Err = unix.GetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT)
+		ipv6, ipv6Err = unix.GetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT)
+	}); err != nil {
+		t.Fatalf("Control() error = %v", err)
+	}
+	if ipv4Err != nil || ipv6Err != nil {
+		t.Fatalf("getsockopt errors = %v, %v", ipv4Err, ipv6Err)
+	}
+	if ipv4 != 1 || ipv6 != 1 {
+		t.Fatalf("IP_TRANSPARENT = %d, IPV6_TRANSPARENT = %d; want both 1", ipv4, ipv6)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, fmt.Errorf("transparent proxy is only supported on Linux")
+}
+
+func originalDestination(conn net.Conn, tproxy bool) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("transparent proxy is only supported on Linux")
+}
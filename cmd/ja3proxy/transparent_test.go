@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandleTransparentForwardsPlainTCP(t *testing.T) {
+	destConn, upstreamPeer := net.Pipe()
+	defer upstreamPeer.Close()
+
+	dialed := make(chan string, 1)
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return destConn, nil
+	}, func(sni string, destConn net.Conn, clientConn net.Conn) {
+		t.Error("plain TCP should not use TLS MITM connect")
+	}, nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go proxy.handleTransparent(serverConn, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 80})
+
+	if err := clientConn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if err := upstreamPeer.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := clientConn.Write([]byte("ping")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if addr := <-dialed; addr != "192.0.2.10:80" {
+		t.Fatalf("dial addr = %q, want 192.0.2.10:80", addr)
+	}
+
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(upstreamPeer, got); err != nil {
+		t.Fatalf("upstream read: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("upstream got %q, want ping", got)
+	}
+}
+
+func TestHandleTransparentConnectsTLSWithSNI(t *testing.T) {
+	destConn, upstreamPeer := net.Pipe()
+	defer upstreamPeer.Close()
+
+	dialed := make(chan string, 1)
+	connected := make(chan string, 1)
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		dialed <- addr
+		return destConn, nil
+	}, func(sni string, destConn net.Conn, clientConn net.Conn) {
+		defer destConn.Close()
+		defer clientConn.Close()
+		connected <- sni
+	}, nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	go proxy.handleTransparent(serverConn, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 8443})
+	go func() {
+		_ = tls.Client(clientConn, &tls.Config{
+			ServerName:         "api.example.com",
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+
+	select {
+	case addr := <-dialed:
+		if addr != "192.0.2.10:8443" {
+			t.Fatalf("dial addr = %q, want 192.0.2.10:8443", addr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for dial")
+	}
+	select {
+	case sni := <-connected:
+		if sni != "api.example.com" {
+			t.Fatalf("connect sni = %q, want api.example.com", sni)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for connect")
+	}
+}
+
+func TestServeTransparentRejectsDirectConnections(t *testing.T) {
+	listener, err := listenTransparent("127.0.0.1:0", false)
+	if err != nil {
+		t.Skipf("transparent listener unavailable: %v", err)
+	}
+	defer listener.Close()
+
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		t.Errorf("dial %s for a connection that was not redirected", addr)
+		return nil, io.EOF
+	}, nil, nil)
+	go proxy.serveTransparent(listener, false)
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial transparent listener: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read succeeded, want closed connection")
+	}
+}
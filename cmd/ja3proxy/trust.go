@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	trustCertFileName = "ja3proxy-ca.crt"
+	trustCertNickname = "ja3proxy CA"
+)
+
+type systemTrustStore struct {
+	name   string
+	dir    string
+	update []string
+}
+
+var systemTrustStores = []systemTrustStore{
+	{name: "debian", dir: "/usr/local/share/ca-certificates", update: []string{"update-ca-certificates", "--fresh"}},
+	{name: "redhat", dir: "/etc/pki/ca-trust/source/anchors", update: []string{"update-ca-trust", "extract"}},
+	{name: "arch", dir: "/etc/ca-certificates/trust-source/anchors", update: []string{"trust", "extract-compat"}},
+}
+
+var nssDatabaseGlobs = []string{
+	".pki/nssdb",
+	".mozilla/firefox/*",
+	"snap/firefox/common/.mozilla/firefox/*",
+	"snap/chromium/current/.pki/nssdb",
+}
+
+type TrustInstaller struct {
+	Root     string
+	Home     string
+	Nickname string
+	Out      io.Writer
+
+	runCommand func(name string, args ...string) ([]byte, error)
+	lookPath   func(file string) (string, error)
+}
+
+func newTrustInstaller(out io.Writer) *TrustInstaller {
+	return &TrustInstaller{
+		Root:     "/",
+		Home:     trustHomeDir(os.Geteuid(), os.Getenv("SUDO_USER"), user.Lookup),
+		Nickname: trustCertNickname,
+		Out:      out,
+	}
+}
+
+// trustHomeDir returns the home directory whose NSS databases are updated.
+// Under sudo that is the invoking user's home, not root's.
+func trustHomeDir(euid int, sudoUser string, lookupUser func(string) (*user.User, error)) string {
+	if euid == 0 && sudoUser != "" && sudoUser != "root" {
+		if account, err := lookupUser(sudoUser); err == nil && account.HomeDir != "" {
+			return account.HomeDir
+		}
+	}
+	home, _ := os.UserHomeDir()
+	return home
+}
+
+func (installer *TrustInstaller) run(name string, args ...string) ([]byte, error) {
+	if installer.runCommand != nil {
+		return installer.runCommand(name, args...)
+	}
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+func (installer *TrustInstaller) hasCommand(name string) bool {
+	lookPath := installer.lookPath
+	if lookPath == nil {
+		lookPath = exec.LookPath
+	}
+	_, err := lookPath(name)
+	return err == nil
+}
+
+func (installer *TrustInstaller) report(format string, args ...any) {
+	if installer.Out != nil {
+		fmt.Fprintf(installer.Out, format+"\n", args...)
+	}
+}
+
+func (installer *TrustInstaller) systemStore() (systemTrustStore, bool) {
+	for _, store := range systemTrustStores {
+		if !installer.hasCommand(store.update[0]) {
+			continue
+		}
+		if stat, err := os.Stat(filepath.Join(installer.Root, store.dir)); err == nil && stat.IsDir() {
+			return store, true
+		}
+	}
+	return systemTrustStore{}, false
+}
+
+func (installer *TrustInstaller) InstallSystem(certPEM []byte) (bool, error) {
+	store, ok := installer.systemStore()
+	if !ok {
+		installer.report("system: no supported trust store found")
+		return false, nil
+	}
+
+	path := filepath.Join(installer.Root, store.dir, trustCertFileName)
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, certPEM) {
+		installer.report("system: already installed at %s", path)
+		return false, nil
+	}
+	if err := os.WriteFile(path, certPEM, 0644); err != nil {
+		if os.IsPermission(err) {
+			return false, fmt.Errorf("write %s: %w (system install requires root)", path, err)
+		}
+		return false, fmt.Errorf("write %s: %w", path, err)
+	}
+	if output, err := installer.run(store.update[0], store.update[1:]...); err != nil {
+		return true, fmt.Errorf("%s: %w: %s", strings.Join(store.update, " "), err, bytes.TrimSpace(output))
+	}
+
+	installer.report("system: installed %s (%s)", path, store.name)
+	return true, nil
+}
+
+func (installer *TrustInstaller) UninstallSystem() (bool, error) {
+	store, ok := installer.systemStore()
+	if !ok {
+		installer.report("system: no supported trust store found")
+		return false, nil
+	}
+
+	path := filepath.Join(installer.Root, store.dir, trustCertFileName)
+	if !fileExists(path) {
+		installer.report("system: not installed at %s", path)
+		return false, nil
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsPermission(err) {
+			return false, fmt.Errorf("remove %s: %w (system uninstall requires root)", path, err)
+		}
+		return false, fmt.Errorf("remove %s: %w", path, err)
+	}
+	if output, err := installer.run(store.update[0], store.update[1:]...); err != nil {
+		return true, fmt.Errorf("%s: %w: %s", strings.Join(store.update, " "), err, bytes.TrimSpace(output))
+	}
+
+	installer.report("system: removed %s (%s)", path, store.name)
+	return true, nil
+}
+
+func (installer *TrustInstaller) nssDatabases() []string {
+	var databases []string
+	for _, pattern := range nssDatabaseGlobs {
+		matches, _ := filepath.Glob(filepath.Join(installer.Home, pattern))
+		for _, dir := range matches {
+			if fileExists(filepath.Join(dir, "cert9.db")) {
+				databases = append(databases, dir)
+			}
+		}
+	}
+	return databases
+}
+
+func (installer *TrustInstaller) nssCertificate(dir string) ([]byte, bool) {
+	output, err := installer.run("certutil", "-d", "sql:"+dir, "-L", "-n", installer.Nickname, "-a")
+	if err != nil {
+		return nil, false
+	}
+	return output, true
+}
+
+func (installer *TrustInstaller) InstallNSS(certPath string, certPEM []byte) (int, error) {
+	if !installer.hasCommand("certutil") {
+		installer.report("nss: certutil not found, install libnss3-tools or nss-tools")
+		return 0, nil
+	}
+
+	databases := installer.nssDatabases()
+	if len(databases) == 0 {
+		installer.report("nss: no NSS databases found under %s", installer.Home)
+		return 0, nil
+	}
+
+	changed := 0
+	for _, dir := range databases {
+		if existing, ok := installer.nssCertificate(dir); ok {
+			if samePEMCertificate(existing, certPEM) {
+				installer.report("nss: already installed in %s", dir)
+				continue
+			}
+			if output, err := installer.run("certutil", "-d", "sql:"+dir, "-D", "-n", installer.Nickname); err != nil {
+				return changed, fmt.Errorf("certutil remove stale %s: %w: %s", dir, err, bytes.TrimSpace(output))
+			}
+		}
+
+		if output, err := installer.run("certutil", "-d", "sql:"+dir, "-A", "-t", "C,,", "-n", installer.Nickname, "-i", certPath); err != nil {
+			return changed, fmt.Errorf("certutil add %s: %w: %s", dir, err, bytes.TrimSpace(output))
+		}
+		installer.report("nss: installed in %s", dir)
+		changed++
+	}
+	return changed, nil
+}
+
+func (installer *TrustInstaller) UninstallNSS() (int, error) {
+	if !installer.hasCommand("certutil") {
+		installer.report("nss: certutil not found, install libnss3-tools or nss-tools")
+		return 0, nil
+	}
+
+	changed := 0
+	for _, dir := range installer.nssDatabases() {
+		if _, ok := installer.nssCertificate(dir); !ok {
+			installer.report("nss: not installed in %s", dir)
+			continue
+		}
+		if output, err := installer.run("certutil", "-d", "sql:"+dir, "-D", "-n", installer.Nickname); err != nil {
+			return changed, fmt.Errorf("certutil remove %s: %w: %s", dir, err, bytes.TrimSpace(output))
+		}
+		installer.report("nss: removed from %s", dir)
+		changed++
+	}
+	return changed, nil
+}
+
+func samePEMCertificate(a, b []byte) bool {
+	blockA, _ := pem.Decode(a)
+	blockB, _ := pem.Decode(b)
+	return blockA != nil && blockB != nil && bytes.Equal(blockA.Bytes, blockB.Bytes)
+}
+
+func runCACommand(args []string, out io.Writer) error {
+	if len(args) == 0 || (args[0] != "install" && args[0] != "uninstall") {
+		return fmt.Errorf("usage: ja3proxy ca install|uninstall [flags]")
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("ca "+action, flag.ContinueOnError)
+	certPath := flags.String("cert", "credentials/cert.pem", "proxy CA cert")
+	system := flags.Bool("system", true, "update the system trust store")
+	nss := flags.Bool("nss", true, "update the user's NSS databases used by Firefox and Chrome")
+	nickname := flags.String("name", trustCertNickname, "certificate nickname in NSS databases")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("ca %s is only supported on Linux", action)
+	}
+
+	installer := newTrustInstaller(out)
+	installer.Nickname = *nickname
+	if action == "uninstall" {
+		return installer.uninstall(*system, *nss)
+	}
+
+	certPEM, err := os.ReadFile(*certPath)
+	if err != nil {
+		return fmt.Errorf("read CA cert: %w", err)
+	}
+	if block, _ := pem.Decode(certPEM); block == nil || block.Type != "CERTIFICATE" {
+		return fmt.Errorf("CA cert %q is not a PEM certificate", *certPath)
+	}
+	absCertPath, err := filepath.Abs(*certPath)
+	if err != nil {
+		return err
+	}
+	return installer.install(absCertPath, certPEM, *system, *nss)
+}
+
+// install updates the system store and the NSS databases independently, so a
+// failure in one does not leave the other untouched.
+func (installer *TrustInstaller) install(certPath string, certPEM []byte, system bool, nss bool) error {
+	var systemErr, nssErr error
+	if system {
+		_, systemErr = installer.InstallSystem(certPEM)
+	}
+	if nss {
+		_, nssErr = installer.InstallNSS(certPath, certPEM)
+	}
+	return errors.Join(systemErr, nssErr)
+}
+
+func (installer *TrustInstaller) uninstall(system bool, nss bool) error {
+	var systemErr, nssErr error
+	if system {
+		_, systemErr = installer.UninstallSystem()
+	}
+	if nss {
+		_, nssErr = installer.UninstallNSS()
+	}
+	return errors.Join(systemErr, nssErr)
+}
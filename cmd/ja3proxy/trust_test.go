@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeTrustCommands struct {
+	commands []string
+	nss      map[string][]byte
+	certPEM  []byte
+}
+
+func (fake *fakeTrustCommands) run(name string, args ...string) ([]byte, error) {
+	fake.commands = append(fake.commands, strings.Join(append([]string{name}, args...), " "))
+	if name != "certutil" {
+		return nil, nil
+	}
+
+	dir := strings.TrimPrefix(args[1], "sql:")
+	switch args[2] {
+	case "-L":
+		if cert, ok := fake.nss[dir]; ok {
+			return cert, nil
+		}
+		return []byte("certutil: could not find certificate"), fmt.Errorf("exit status 255")
+	case "-D":
+		delete(fake.nss, dir)
+	case "-A":
+		fake.nss[dir] = fake.certPEM
+	}
+	return nil, nil
+}
+
+func newTestTrustInstaller(t *testing.T, certPEM []byte) (*TrustInstaller, *fakeTrustCommands, *bytes.Buffer) {
+	t.Helper()
+
+	root := t.TempDir()
+	home := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, systemTrustStores[0].dir), 0755); err != nil {
+		t.Fatalf("create trust dir: %v", err)
+	}
+	nssDir := filepath.Join(home, ".pki", "nssdb")
+	if err := os.MkdirAll(nssDir, 0700); err != nil {
+		t.Fatalf("create nss dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(nssDir, "cert9.db"), nil, 0600); err != nil {
+		t.Fatalf("create nss db: %v", err)
+	}
+
+	fake := &fakeTrustCommands{nss: map[string][]byte{}, certPEM: certPEM}
+	out := &bytes.Buffer{}
+	installer := &TrustInstaller{
+		Root:       root,
+		Home:       home,
+		Nickname:   trustCertNickname,
+		Out:        out,
+		runCommand: fake.run,
+		lookPath: func(file string) (string, error) {
+			if file == "update-ca-certificates" || file == "certutil" {
+				return "/usr/bin/" + file, nil
+			}
+			return "", exec.ErrNotFound
+		},
+	}
+	return installer, fake, out
+}
+
+func readTestCACert(t *testing.T) (string, []byte) {
+	t.Helper()
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "ca.pem")
+	if err := (&CertificateAuthority{}).Generate(certPath, filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Fatalf("CertificateAuthority.Generate() error = %v", err)
+	}
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		t.Fatalf("read CA cert: %v", err)
+	}
+	return certPath, certPEM
+}
+
+func TestTrustInstallerInstallIsIdempotent(t *testing.T) {
+	certPath, certPEM := readTestCACert(t)
+	installer, fake, out := newTestTrustInstaller(t, certPEM)
+
+	if err := installer.install(certPath, certPEM, true, true); err != nil {
+		t.Fatalf("install() error = %v", err)
+	}
+	installed := filepath.Join(installer.Root, systemTrustStores[0].dir, trustCertFileName)
+	got, err := os.ReadFile(installed)
+	if err != nil {
+		t.Fatalf("read installed cert: %v", err)
+	}
+	if !bytes.Equal(got, certPEM) {
+		t.Fatal("installed system cert does not match CA cert")
+	}
+	if len(fake.nss) != 1 {
+		t.Fatalf("nss databases with cert = %d, want 1", len(fake.nss))
+	}
+	if !strings.Contains(out.String(), "system: installed") || !strings.Contains(out.String(), "nss: installed in") {
+		t.Fatalf("report = %q, want installed lines", out.String())
+	}
+
+	fake.commands = nil
+	out.Reset()
+	if err := installer.install(certPath, certPEM, true, true); err != nil {
+		t.Fatalf("second install() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "system: already installed") || !strings.Contains(out.String(), "nss: already installed") {
+		t.Fatalf("report = %q, want already installed lines", out.String())
+	}
+	for _, command := range fake.commands {
+		if strings.HasPrefix(command, "update-ca-certificates") || strings.Contains(command, " -A ") {
+			t.Fatalf("second install ran %q, want no changes", command)
+		}
+	}
+}
+
+func TestTrustInstallerUninstallRemovesCert(t *testing.T) {
+	certPath, certPEM := readTestCACert(t)
+	installer, fake, out := newTestTrustInstaller(t, certPEM)
+	if err := installer.install(certPath, certPEM, true, true); err != nil {
+		t.Fatalf("install() error = %v", err)
+	}
+
+	out.Reset()
+	if err := installer.uninstall(true, true); err != nil {
+		t.Fatalf("uninstall() error = %v", err)
+	}
+	if fileExists(filepath.Join(installer.Root, systemTrustStores[0].dir, trustCertFileName)) {
+		t.Fatal("system cert still present after uninstall")
+	}
+	if len(fake.nss) != 0 {
+		t.Fatalf("nss databases with cert = %d, want 0", len(fake.nss))
+	}
+	if !strings.Contains(out.String(), "system: removed") || !strings.Contains(out.String(), "nss: removed from") {
+		t.Fatalf("report = %q, want removed lines", out.String())
+	}
+
+	out.Reset()
+	if err := installer.uninstall(true, true); err != nil {
+		t.Fatalf("second uninstall() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "system: not installed") || !strings.Contains(out.String(), "nss: not installed") {
+		t.Fatalf("report = %q, want not installed lines", out.String())
+	}
+}
+
+func TestTrustInstallerInstallUpdatesNSSWhenSystemFails(t *testing.T) {
+	certPath, certPEM := readTestCACert(t)
+	installer, fake, _ := newTestTrustInstaller(t, certPEM)
+	run := fake.run
+	installer.runCommand = func(name string, args ...string) ([]byte, error) {
+		if name == "update-ca-certificates" {
+			return []byte("permission denied"), fmt.Errorf("exit status 1")
+		}
+		return run(name, args...)
+	}
+
+	err := installer.install(certPath, certPEM, true, true)
+	if err == nil {
+		t.Fatal("install() error = nil, want the system store error")
+	}
+	if len(fake.nss) != 1 {
+		t.Fatalf("nss databases with cert = %d after system failure, want 1", len(fake.nss))
+	}
+}
+
+func TestTrustHomeDirUsesSudoUser(t *testing.T) {
+	lookup := func(name string) (*user.User, error) {
+		if name != "alice" {
+			return nil, user.UnknownUserError(name)
+		}
+		return &user.User{Username: "alice", HomeDir: "/home/alice"}, nil
+	}
+	if got := trustHomeDir(0, "alice", lookup); got != "/home/alice" {
+		t.Fatalf("trustHomeDir() under sudo = %q, want /home/alice", got)
+	}
+	home, _ := os.UserHomeDir()
+	if got := trustHomeDir(1000, "alice", lookup); got != home {
+		t.Fatalf("trustHomeDir() without root = %q, want %q", got, home)
+	}
+}
+
+func TestRunCACommandRejectsUnknownAction(t *testing.T) {
+	if err := runCACommand([]string{"trust"}, &bytes.Buffer{}); err == nil {
+		t.Fatal("runCACommand() error = nil, want usage error")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const tunnelSniffTime = 100 * time.Millisecond
+
+var httpRequestMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("PATCH "),
+	[]byte("TRACE "),
+}
+
+func (p *Proxy) handleSniffedTunnel(host string, port uint16, destConn net.Conn, clientConn net.Conn, reader *bufio.Reader) {
+	// Port 443 is TLS without waiting for the client, so a slow ClientHello
+	// still gets the MITM and uTLS path.
+	if port == 443 {
+		if reader.Buffered() > 0 {
+			clientConn = &bufferedReadConn{
+				Conn:   clientConn,
+				reader: reader,
+			}
+		}
+		p.connect(host, destConn, clientConn)
+		return
+	}
+
+	tunnelClientConn := &bufferedReadConn{
+		Conn:   clientConn,
+		reader: reader,
+	}
+
+	isTLS, err := sniffTLS(clientConn, reader)
+	if err != nil {
+		destConn.Close()
+		log.Printf("tunnel client read error: %v", err)
+		return
+	}
+	if isTLS {
+		p.connect(host, destConn, tunnelClientConn)
+		return
+	}
+
+	if p != nil && p.tunnelHTTP {
+		isHTTP, err := sniffHTTP(clientConn, reader)
+		if err != nil {
+			destConn.Close()
+			log.Printf("tunnel client read error: %v", err)
+			return
+		}
+		if isHTTP {
+			destConn.Close()
+			p.serveTunnelHTTP(net.JoinHostPort(host, strconv.Itoa(int(port))), tunnelClientConn, destConn)
+			return
+		}
+	}
+
+	defer destConn.Close()
+	junction(destConn, tunnelClientConn)
+}
+
+func peekWithin(clientConn net.Conn, reader *bufio.Reader, n int) ([]byte, error) {
+	if err := clientConn.SetReadDeadline(time.Now().Add(tunnelSniffTime)); err != nil {
+		return nil, fmt.Errorf("set read deadline: %w", err)
+	}
+	peeked, err := reader.Peek(n)
+	if deadlineErr := clientConn.SetReadDeadline(time.Time{}); deadlineErr != nil {
+		return nil, fmt.Errorf("clear read deadline: %w", deadlineErr)
+	}
+	if err != nil {
+		if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+			return nil, err
+		}
+	}
+	return peeked, nil
+}
+
+func sniffTLS(clientConn net.Conn, reader *bufio.Reader) (bool, error) {
+	first, err := peekWithin(clientConn, reader, 1)
+	if err != nil {
+		return false, err
+	}
+	return len(first) > 0 && first[0] == tlsHandshakeRecord, nil
+}
+
+func sniffHTTP(clientConn net.Conn, reader *bufio.Reader) (bool, error) {
+	prefix, err := peekWithin(clientConn, reader, len("OPTIONS "))
+	if err != nil {
+		return false, err
+	}
+	for _, method := range httpRequestMethods {
+		if bytes.HasPrefix(prefix, method) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// serveTunnelHTTP serves plain HTTP from the tunnel with the session and
+// upstream credentials destConn was dialed with.
+func (p *Proxy) serveTunnelHTTP(target string, clientConn, destConn net.Conn) {
+	log.Printf("tunnel HTTP to %s", target)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = target
+			p.handleHTTP(w, r.WithContext(withConnSession(r.Context(), destConn)))
+		}),
+	}
+	_ = server.Serve(newSingleConnListener(clientConn))
+}
+
+// singleConnListener hands out one connection and blocks further Accept calls
+// until that connection is closed, so serving it does not outlive the caller.
+type singleConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (conn *notifyCloseConn) Close() error {
+	conn.once.Do(func() {
+		close(conn.closed)
+	})
+	return conn.Conn.Close()
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	closed := make(chan struct{})
+	return &singleConnListener{
+		conn: &notifyCloseConn{
+			Conn:   conn,
+			closed: closed,
+		},
+		closed: closed,
+	}
+}
+
+func (listener *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	listener.once.Do(func() {
+		conn = listener.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-listener.closed
+	return nil, net.ErrClosed
+}
+
+func (listener *singleConnListener) Close() error {
+	return nil
+}
+
+func (listener *singleConnListener) Addr() net.Addr {
+	return listener.conn.LocalAddr()
+}
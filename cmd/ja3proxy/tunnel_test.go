@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openConnectTunnel(t *testing.T, proxy *Proxy, target string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(server.URL, "http://"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"); err != nil {
+		t.Fatalf("write CONNECT request: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", resp.StatusCode)
+	}
+	return conn, reader
+}
+
+func TestConnectTunnelForwardsServerFirstProtocol(t *testing.T) {
+	destConn, upstreamPeer := net.Pipe()
+	defer upstreamPeer.Close()
+
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		return destConn, nil
+	}, func(sni string, destConn net.Conn, clientConn net.Conn) {
+		t.Error("non-TLS CONNECT tunnel should not use TLS MITM connect")
+	}, nil)
+	conn, reader := openConnectTunnel(t, proxy, "git.example.com:22")
+
+	if err := upstreamPeer.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(upstreamPeer, "SSH-2.0-test\r\n"); err != nil {
+		t.Fatalf("upstream write: %v", err)
+	}
+	banner, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read banner: %v", err)
+	}
+	if banner != "SSH-2.0-test\r\n" {
+		t.Fatalf("banner = %q, want SSH-2.0-test", banner)
+	}
+
+	if _, err := io.WriteString(conn, "SSH-2.0-client\r\n"); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	got, err := bufio.NewReader(upstreamPeer).ReadString('\n')
+	if err != nil {
+		t.Fatalf("upstream read: %v", err)
+	}
+	if got != "SSH-2.0-client\r\n" {
+		t.Fatalf("upstream got %q, want SSH-2.0-client", got)
+	}
+}
+
+func TestConnectTunnelDetectsTLSOnNonStandardPort(t *testing.T) {
+	destConn, upstreamPeer := net.Pipe()
+	defer upstreamPeer.Close()
+
+	connected := make(chan string, 1)
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		return destConn, nil
+	}, func(sni string, destConn net.Conn, clientConn net.Conn) {
+		defer destConn.Close()
+		defer clientConn.Close()
+		connected <- sni
+	}, nil)
+	conn, _ := openConnectTunnel(t, proxy, "api.example.com:8443")
+
+	go func() {
+		_ = tls.Client(conn, &tls.Config{
+			ServerName:         "api.example.com",
+			InsecureSkipVerify: true,
+		}).Handshake()
+	}()
+
+	select {
+	case sni := <-connected:
+		if sni != "api.example.com" {
+			t.Fatalf("connect sni = %q, want api.example.com", sni)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for connect")
+	}
+}
+
+func TestConnectTunnelServesPlainHTTPWhenEnabled(t *testing.T) {
+	destConn, upstreamPeer := net.Pipe()
+	defer upstreamPeer.Close()
+
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		return destConn, nil
+	}, nil, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "http://example.com:8080/status" {
+			t.Errorf("upstream URL = %q, want http://example.com:8080/status", req.URL.String())
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("tunneled http")),
+		}, nil
+	}))
+	proxy.tunnelHTTP = true
+	conn, reader := openConnectTunnel(t, proxy, "example.com:8080")
+
+	if _, err := io.WriteString(conn, "GET /status HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"); err != nil {
+		t.Fatalf("write tunneled request: %v", err)
+	}
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read tunneled response: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if string(body) != "tunneled http" {
+		t.Fatalf("body = %q, want tunneled http", body)
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	tests := map[string]bool{
+		"GET / HTTP/1.1\r\n":      true,
+		"OPTIONS * HTTP/1.1\r\n":  true,
+		"SSH-2.0-OpenSSH_9.6\r\n": false,
+		"\x00\x01binary protocol": false,
+	}
+	for input, want := range tests {
+		clientConn, serverConn := net.Pipe()
+		go func() {
+			_, _ = io.WriteString(clientConn, input)
+		}()
+
+		got, err := sniffHTTP(serverConn, bufio.NewReader(serverConn))
+		clientConn.Close()
+		serverConn.Close()
+		if err != nil {
+			t.Fatalf("sniffHTTP(%q) error = %v", input, err)
+		}
+		if got != want {
+			t.Fatalf("sniffHTTP(%q) = %v, want %v", input, got, want)
+		}
+	}
+}
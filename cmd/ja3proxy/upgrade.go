@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var websocketOpcodes = map[byte]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xa: "pong",
+}
+
+func upgradeProtocol(header http.Header) string {
+	if !headerContainsToken(header, "Connection", "upgrade") {
+		return ""
+	}
+	return firstToken(header.Get("Upgrade"))
+}
+
+func firstToken(value string) string {
+	token, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(token)
+}
+
+func upgradeAddress(target *url.URL) string {
+	if target.Port() != "" {
+		return target.Host
+	}
+	if target.Scheme == "https" {
+		return net.JoinHostPort(target.Hostname(), "443")
+	}
+	return net.JoinHostPort(target.Hostname(), "80")
+}
+
+func (p *Proxy) dialUpgrade(req *http.Request) (net.Conn, error) {
+	addr := upgradeAddress(req.URL)
+	ctx := withUpstreamClient(req.Context(), req.RemoteAddr)
+	if req.URL.Scheme != "https" {
+		return p.dialContext(ctx, "tcp", addr)
+	}
+	if p != nil {
+		// Upgrades need HTTP/1.1, which is also all browsers offer for
+		// WebSocket connections.
+		if transport, ok := p.originTransport.(*originTransport); ok {
+			return transport.dialTLS(ctx, addr, []string{"http/1.1"})
+		}
+	}
+
+	conn, err := p.dialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName: req.URL.Hostname(),
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := tlsConn.HandshakeContext(req.Context()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// upgradeUpstream dials the target and sends the upgrade handshake. It returns
+// false once it has answered the client itself, either with an error or with
+// a response that did not switch protocols.
+func (p *Proxy) upgradeUpstream(w http.ResponseWriter, outReq *http.Request, protocol string) (net.Conn, *http.Response, bool) {
+	destConn, err := p.dialUpgrade(outReq)
+	if err != nil {
+		http.Error(w, err.Error(), dialErrorStatus(err))
+		log.Println("upgrade dial error: ", err)
+		return nil, nil, false
+	}
+
+	outReq.Header.Set("Connection", "Upgrade")
+	outReq.Header.Set("Upgrade", protocol)
+	if err := outReq.Write(destConn); err != nil {
+		destConn.Close()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		log.Println("upgrade request write error: ", err)
+		return nil, nil, false
+	}
+
+	destReader := bufio.NewReader(destConn)
+	resp, err := http.ReadResponse(destReader, outReq)
+	if err != nil {
+		destConn.Close()
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		log.Println("upgrade response read error: ", err)
+		return nil, nil, false
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer destConn.Close()
+		defer resp.Body.Close()
+		p.writeForwardResponse(w, resp)
+		return nil, nil, false
+	}
+	if upgraded := resp.Header.Get("Upgrade"); !strings.EqualFold(firstToken(upgraded), protocol) {
+		destConn.Close()
+		http.Error(w, fmt.Sprintf("upstream switched to %q, want %q", upgraded, protocol), http.StatusBadGateway)
+		log.Printf("upgrade protocol mismatch: got %q, want %q", upgraded, protocol)
+		return nil, nil, false
+	}
+
+	removeHopByHopHeaders(resp.Header)
+	p.addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	return &bufferedReadConn{
+		Conn:   destConn,
+		reader: destReader,
+	}, resp, true
+}
+
+func (p *Proxy) handleUpgrade(w http.ResponseWriter, outReq *http.Request, protocol string) {
+	log.Printf("upgrade %s to %s", protocol, outReq.URL.Host)
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		log.Println("Hijacking not supported")
+		return
+	}
+
+	destConn, resp, ok := p.upgradeUpstream(w, outReq, protocol)
+	if !ok {
+		return
+	}
+
+	clientConn, clientRW, err := hijacker.Hijack()
+	if err != nil {
+		destConn.Close()
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		log.Println("Hijack error: ", err)
+		return
+	}
+
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", protocol)
+	fmt.Fprintf(clientRW, "HTTP/1.1 %d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(clientRW)
+	clientRW.WriteString("\r\n")
+	if err := clientRW.Flush(); err != nil {
+		destConn.Close()
+		clientConn.Close()
+		log.Println("upgrade response write error: ", err)
+		return
+	}
+
+	p.pipeUpgrade(destConn, &bufferedReadConn{
+		Conn:   clientConn,
+		reader: clientRW.Reader,
+	}, protocol)
+}
+
+func (p *Proxy) pipeUpgrade(destConn net.Conn, clientConn net.Conn, protocol string) {
+	if p == nil || !p.debug {
+		junction(destConn, clientConn)
+		return
+	}
+	if !strings.EqualFold(protocol, "websocket") {
+		debugJunction(destConn, clientConn)
+		return
+	}
+
+	pipeConns(destConn, clientConn, &websocketFrameLogger{
+		name: clientConn.RemoteAddr().String(),
+		conn: destConn,
+	}, &websocketFrameLogger{
+		name: destConn.RemoteAddr().String(),
+		conn: clientConn,
+	})
+}
+
+type websocketFrame struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	payload uint64
+}
+
+func (frame websocketFrame) String() string {
+	opcode, ok := websocketOpcodes[frame.opcode]
+	if !ok {
+		opcode = fmt.Sprintf("0x%x", frame.opcode)
+	}
+	return fmt.Sprintf("%s fin=%t masked=%t payload=%d", opcode, frame.fin, frame.masked, frame.payload)
+}
+
+// websocketFrameParser follows frame boundaries across writes without
+// buffering payloads, so it can watch a stream that is relayed unchanged.
+type websocketFrameParser struct {
+	header []byte
+	skip   uint64
+}
+
+func (parser *websocketFrameParser) feed(data []byte) []websocketFrame {
+	var frames []websocketFrame
+	for len(data) > 0 {
+		if parser.skip > 0 {
+			n := min(uint64(len(data)), parser.skip)
+			parser.skip -= n
+			data = data[n:]
+			continue
+		}
+
+		parser.header = append(parser.header, data[0])
+		data = data[1:]
+		size, ok := websocketHeaderSize(parser.header)
+		if !ok || len(parser.header) < size {
+			continue
+		}
+
+		frame := parseWebsocketHeader(parser.header)
+		frames = append(frames, frame)
+		parser.skip = frame.payload
+		parser.header = parser.header[:0]
+	}
+	return frames
+}
+
+func websocketHeaderSize(header []byte) (int, bool) {
+	if len(header) < 2 {
+		return 0, false
+	}
+	size := 2
+	switch header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size, true
+}
+
+func parseWebsocketHeader(header []byte) websocketFrame {
+	frame := websocketFrame{
+		fin:     header[0]&0x80 != 0,
+		opcode:  header[0] & 0x0f,
+		masked:  header[1]&0x80 != 0,
+		payload: uint64(header[1] & 0x7f),
+	}
+	switch frame.payload {
+	case 126:
+		frame.payload = uint64(binary.BigEndian.Uint16(header[2:4]))
+	case 127:
+		frame.payload = binary.BigEndian.Uint64(header[2:10])
+	}
+	return frame
+}
+
+type websocketFrameLogger struct {
+	name   string
+	conn   net.Conn
+	parser websocketFrameParser
+}
+
+func (logger *websocketFrameLogger) Write(data []byte) (int, error) {
+	for _, frame := range logger.parser.feed(data) {
+		log.Printf("%s websocket frame %s", logger.name, frame)
+	}
+	return logger.conn.Write(data)
+}
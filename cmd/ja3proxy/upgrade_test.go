@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newWebsocketEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerContainsToken(r.Header, "Connection", "upgrade") {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.WriteString(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-Websocket-Accept: test\r\n\r\n")
+		_ = rw.Flush()
+		_, _ = io.Copy(conn, rw)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func sendUpgradeRequest(t *testing.T, proxyURL string, target string, upgrade string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", strings.TrimPrefix(proxyURL, "http://"), 2*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	if err := conn.SetDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	request := "GET http://" + target + "/socket HTTP/1.1\r\nHost: " + target +
+		"\r\nConnection: Upgrade\r\nUpgrade: " + upgrade + "\r\nSec-Websocket-Key: dGVzdA==\r\n\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatalf("write upgrade request: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("read upgrade response: %v", err)
+	}
+	return conn, reader, resp
+}
+
+func TestHandleHTTPUpgradesWebsocketThroughDialer(t *testing.T) {
+	upstream := newWebsocketEchoServer(t)
+	upstreamAddr := strings.TrimPrefix(upstream.URL, "http://")
+
+	var dialed []string
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return net.DialTimeout(network, upstreamAddr, 2*time.Second)
+	}, nil, roundTripFunc(func(*http.Request) (*http.Response, error) {
+		t.Error("upgrade request should not use the HTTP transport")
+		return nil, io.EOF
+	}))
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	conn, reader, resp := sendUpgradeRequest(t, proxyServer.URL, "ws.example.com", "websocket")
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status code = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Upgrade"); got != "websocket" {
+		t.Fatalf("Upgrade = %q, want websocket", got)
+	}
+	if got := resp.Header.Get("Sec-Websocket-Accept"); got != "test" {
+		t.Fatalf("Sec-Websocket-Accept = %q, want test", got)
+	}
+	if !reflect.DeepEqual(dialed, []string{"ws.example.com:80"}) {
+		t.Fatalf("dialed = %v, want [ws.example.com:80]", dialed)
+	}
+
+	if _, err := io.WriteString(conn, "\x81\x02hi"); err != nil {
+		t.Fatalf("write frame: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatalf("read echoed frame: %v", err)
+	}
+	if string(got) != "\x81\x02hi" {
+		t.Fatalf("echoed frame = %q, want text frame", got)
+	}
+}
+
+func TestHandleHTTPForwardsRejectedUpgrade(t *testing.T) {
+	upstream := newWebsocketEchoServer(t)
+	upstreamAddr := strings.TrimPrefix(upstream.URL, "http://")
+
+	proxyServer := httptest.NewServer(NewProxy(func(network, addr string) (net.Conn, error) {
+		return net.DialTimeout(network, upstreamAddr, 2*time.Second)
+	}, nil, nil))
+	t.Cleanup(proxyServer.Close)
+
+	_, reader, resp := sendUpgradeRequest(t, proxyServer.URL, "ws.example.com", "h2c")
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("status code = %d, want %d", resp.StatusCode, http.StatusUpgradeRequired)
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, resp.ContentLength))
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if !strings.Contains(string(body), "upgrade required") {
+		t.Fatalf("body = %q, want upstream error", body)
+	}
+}
+
+func TestUpgradeProtocol(t *testing.T) {
+	tests := []struct {
+		header http.Header
+		want   string
+	}{
+		{http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}}, "websocket"},
+		{http.Header{"Connection": {"upgrade"}, "Upgrade": {"h2c, websocket"}}, "h2c"},
+		{http.Header{"Upgrade": {"websocket"}}, ""},
+		{http.Header{"Connection": {"Upgrade"}}, ""},
+	}
+	for _, test := range tests {
+		if got := upgradeProtocol(test.header); got != test.want {
+			t.Fatalf("upgradeProtocol(%v) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestWebsocketFrameParserTracksFramesAcrossWrites(t *testing.T) {
+	var parser websocketFrameParser
+	stream := []byte("\x81\x85mask" + "hello")
+	stream = append(stream, 0x82, 0x7e, 0x01, 0x00)
+	stream = append(stream, make([]byte, 256)...)
+	stream = append(stream, 0x88, 0x00)
+
+	var frames []websocketFrame
+	for _, b := range stream {
+		frames = append(frames, parser.feed([]byte{b})...)
+	}
+
+	want := []websocketFrame{
+		{fin: true, opcode: 0x1, masked: true, payload: 5},
+		{fin: true, opcode: 0x2, payload: 256},
+		{fin: true, opcode: 0x8},
+	}
+	if !reflect.DeepEqual(frames, want) {
+		t.Fatalf("frames = %+v, want %+v", frames, want)
+	}
+	if got := frames[0].String(); got != "text fin=true masked=true payload=5" {
+		t.Fatalf("frame string = %q", got)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamAuthStatic      = "static"
+	upstreamAuthPassthrough = "passthrough"
+	upstreamAuthMap         = "map"
+)
+
+// UpstreamAuthMap maps proxy users to the credentials they use on the
+// upstream proxy.
+type UpstreamAuthMap struct {
+	mu    sync.RWMutex
+	users map[string]*url.Userinfo
+}
+
+func (m *UpstreamAuthMap) Lookup(user string) *url.Userinfo {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.users[user]
+}
+
+func (m *UpstreamAuthMap) Set(users map[string]*url.Userinfo) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users = users
+}
+
+// loadUpstreamAuthFile reads user:upstream-user[:upstream-password] lines. A
+// missing or empty password keeps the one from the upstream URL.
+func loadUpstreamAuthFile(path string) (map[string]*url.Userinfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]*url.Userinfo)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, upstream, ok := strings.Cut(line, ":")
+		if !ok || user == "" || upstream == "" {
+			return nil, fmt.Errorf("line %d: want user:upstream-user[:upstream-password]", lineNumber)
+		}
+		upstreamUser, upstreamPassword, hasPassword := strings.Cut(upstream, ":")
+		if upstreamUser == "" {
+			return nil, fmt.Errorf("line %d: user %s: empty upstream user", lineNumber, user)
+		}
+		if hasPassword && upstreamPassword != "" {
+			users[user] = url.UserPassword(upstreamUser, upstreamPassword)
+		} else {
+			users[user] = url.User(upstreamUser)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (m *UpstreamAuthMap) ApplyFile(path string) error {
+	users, err := loadUpstreamAuthFile(path)
+	if err != nil {
+		return err
+	}
+
+	m.Set(users)
+	log.Printf("loaded %d upstream credentials from %s", len(users), path)
+	return nil
+}
+
+func (m *UpstreamAuthMap) WatchFile(ctx context.Context, path string, interval time.Duration) error {
+	return watchFiles(ctx, interval, "upstream credentials", func() []string {
+		return []string{path}
+	}, func() error {
+		return m.ApplyFile(path)
+	})
+}
+
+// forwardsCredentials reports whether client credentials are needed to
+// authenticate to the upstream proxy.
+func (p *Proxy) forwardsCredentials() bool {
+	return p != nil && (p.upstreamAuth == upstreamAuthPassthrough || p.upstreamAuth == upstreamAuthMap)
+}
+
+// baseUser returns the user to authenticate for username. A name that is a
+// user in its own right is never split into session parameters.
+func (p *Proxy) baseUser(username string) string {
+	if p.users.Has(username) {
+		return username
+	}
+	return p.sessions.BaseUser(username)
+}
+
+// clientContext carries the upstream credentials and session for an
+// authenticated client to its dials. A session credential template takes
+// precedence over forwarded credentials.
+func (p *Proxy) clientContext(ctx context.Context, user, password string) (context.Context, error) {
+	baseUser := p.baseUser(user)
+	switch p.upstreamAuth {
+	case upstreamAuthPassthrough:
+		ctx = withUpstreamAuth(ctx, url.UserPassword(user, password))
+	case upstreamAuthMap:
+		upstreamUser := p.upstreamAuthMap.Lookup(baseUser)
+		if upstreamUser == nil {
+			return nil, fmt.Errorf("no upstream credentials for user %q", user)
+		}
+		ctx = withUpstreamAuth(ctx, upstreamUser)
+	}
+	if baseUser == user {
+		return ctx, nil
+	}
+	return withUpstreamSession(ctx, p.sessions.Resolve(user)), nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+func sendProxyConnect(t *testing.T, proxyAddr, credentials string) int {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+
+	authorization := ""
+	if credentials != "" {
+		authorization = "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+	fmt.Fprintf(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n%s\r\n", authorization)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestLoadUpstreamAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "upstream-auth.txt")
+	content := "# team accounts\nteam-a:acct-a:pa:ss\n\nteam-b:acct-b\nteam-c:acct-c:\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write upstream auth file: %v", err)
+	}
+
+	users, err := loadUpstreamAuthFile(path)
+	if err != nil {
+		t.Fatalf("loadUpstreamAuthFile() error = %v", err)
+	}
+	if len(users) != 3 || users["team-a"].String() != url.UserPassword("acct-a", "pa:ss").String() || users["team-b"].String() != "acct-b" {
+		t.Fatalf("users = %v", users)
+	}
+	if _, ok := users["team-c"].Password(); ok {
+		t.Fatalf("team-c = %v, want an empty password treated as missing", users["team-c"])
+	}
+
+	if err := os.WriteFile(path, []byte("team-a\n"), 0o600); err != nil {
+		t.Fatalf("write upstream auth file: %v", err)
+	}
+	if _, err := loadUpstreamAuthFile(path); err == nil {
+		t.Fatal("expected error for a line without upstream credentials")
+	}
+}
+
+func TestUpstreamAuthPassthroughHTTP(t *testing.T) {
+	upstreamAddr, requests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	dialer, err := NewUpstreamDialer("http://static:secret@"+upstreamAddr, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer() error = %v", err)
+	}
+
+	proxy := NewProxy(dialer.Dial, nil, dialer.Transport)
+	proxy.tunnelDialContext = dialer.DialContext
+	proxy.upstreamAuth = upstreamAuthPassthrough
+	proxyServer := httptest.NewServer(proxy)
+	t.Cleanup(proxyServer.Close)
+
+	if status := sendProxyConnect(t, proxyServer.Listener.Addr().String(), ""); status != http.StatusProxyAuthRequired {
+		t.Fatalf("CONNECT without credentials status = %d, want 407", status)
+	}
+	if status := sendProxyConnect(t, proxyServer.Listener.Addr().String(), "team-a:team-secret"); status != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want 200", status)
+	}
+	request := <-requests
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte("team-a:team-secret"))
+	if request.authorization != want {
+		t.Fatalf("upstream Proxy-Authorization = %q, want %q", request.authorization, want)
+	}
+}
+
+func TestUpstreamAuthMapSOCKS5(t *testing.T) {
+	target := newTCPEchoServer(t)
+	upstream := NewProxy(nil, nil, nil)
+	upstream.users = newTestUserStore(t, map[string]string{"acct-a": "billing-a"})
+	upstreamAddr := newSOCKS5TestServer(t, upstream)
+
+	dialer, err := NewUpstreamDialer("socks5://"+upstreamAddr, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer() error = %v", err)
+	}
+	authMap := &UpstreamAuthMap{}
+	authMap.Set(map[string]*url.Userinfo{"team-a": url.UserPassword("acct-a", "billing-a")})
+
+	proxy := NewProxy(dialer.Dial, nil, dialer.Transport)
+	proxy.tunnelDialContext = dialer.DialContext
+	proxy.users = newTestUserStore(t, map[string]string{"team-a": "pw", "team-b": "pw"})
+	proxy.upstreamAuth = upstreamAuthMap
+	proxy.upstreamAuthMap = authMap
+	proxyAddr := newSOCKS5TestServer(t, proxy)
+
+	unmapped, err := xproxy.SOCKS5("tcp", proxyAddr, &xproxy.Auth{User: "team-b", Password: "pw"}, xproxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5() error = %v", err)
+	}
+	if _, err := unmapped.Dial("tcp", target); err == nil {
+		t.Fatal("user without upstream credentials was let through")
+	}
+
+	client, err := xproxy.SOCKS5("tcp", proxyAddr, &xproxy.Auth{User: "team-a", Password: "pw"}, xproxy.Direct)
+	if err != nil {
+		t.Fatalf("SOCKS5() error = %v", err)
+	}
+	conn, err := client.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("dial through mapped upstream: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo = %q, %v; want ping", got, err)
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// UpstreamProxyError reports a CONNECT that the upstream HTTP proxy refused.
+type UpstreamProxyError struct {
+	StatusCode int
+	Status     string
+}
+
+func (err *UpstreamProxyError) Error() string {
+	return fmt.Sprintf("upstream proxy CONNECT failed: %s", err.Status)
+}
+
+// UpstreamUnreachableError reports that the upstream proxy itself could not be
+// reached, as opposed to the proxy failing to reach the target.
+type UpstreamUnreachableError struct {
+	Proxy string
+	Err   error
+}
+
+func (err *UpstreamUnreachableError) Error() string {
+	return fmt.Sprintf("upstream proxy %s unreachable: %v", err.Proxy, err.Err)
+}
+
+func (err *UpstreamUnreachableError) Unwrap() error {
+	return err.Err
+}
+
+func upstreamUnreachable(proxy string, err error) error {
+	var unreachable *UpstreamUnreachableError
+	if errors.As(err, &unreachable) {
+		return err
+	}
+	return &UpstreamUnreachableError{Proxy: proxy, Err: err}
+}
+
+func isUpstreamUnreachable(err error) bool {
+	var unreachable *UpstreamUnreachableError
+	return errors.As(err, &unreachable)
+}
+
+// UpstreamTLS configures the TLS connection to an https:// upstream proxy.
+// A nil Fingerprint uses crypto/tls instead of uTLS.
+type UpstreamTLS struct {
+	Config      *tls.Config
+	Fingerprint *TLSFingerprint
+}
+
+func (upstreamTLS *UpstreamTLS) handshake(conn net.Conn, serverName string) (net.Conn, error) {
+	config := &tls.Config{}
+	if upstreamTLS != nil && upstreamTLS.Config != nil {
+		config = upstreamTLS.Config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = serverName
+	}
+	config.NextProtos = []string{"http/1.1"}
+
+	if upstreamTLS == nil || upstreamTLS.Fingerprint == nil {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+
+	certificates := make([]utls.Certificate, 0, len(config.Certificates))
+	for _, certificate := range config.Certificates {
+		certificates = append(certificates, utls.Certificate{
+			Certificate: certificate.Certificate,
+			PrivateKey:  certificate.PrivateKey,
+			Leaf:        certificate.Leaf,
+		})
+	}
+	uTLSConn, err := newUTLSClient(conn, &utls.Config{
+		ServerName:         config.ServerName,
+		RootCAs:            config.RootCAs,
+		Certificates:       certificates,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		NextProtos:         config.NextProtos,
+	}, utls.ClientHelloID{
+		Client:  upstreamTLS.Fingerprint.Client,
+		Version: upstreamTLS.Fingerprint.Version,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := uTLSConn.Handshake(); err != nil {
+		return nil, err
+	}
+	return uTLSConn, nil
+}
+
+type httpConnectDialer struct {
+	proxyURL *url.URL
+	proxyTLS *UpstreamTLS
+	timeout  time.Duration
+}
+
+// dialProxy connects to the upstream proxy itself, adding TLS for https://
+// proxies. The caller clears the deadline once the CONNECT has finished.
+func (d *httpConnectDialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", d.proxyURL.Host)
+	if err != nil {
+		return nil, upstreamUnreachable(d.proxyURL.Host, err)
+	}
+	deadline := time.Now().Add(d.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if d.proxyURL.Scheme != "https" {
+		return conn, nil
+	}
+
+	stopCancel := cancelOnDone(ctx, conn)
+	tlsConn, err := d.proxyTLS.handshake(conn, d.proxyURL.Hostname())
+	if !stopCancel() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, upstreamUnreachable(d.proxyURL.Host, fmt.Errorf("upstream proxy TLS: %w", err))
+	}
+	return tlsConn, nil
+}
+
+// cancelOnDone interrupts blocked reads and writes on conn once ctx is done.
+// The returned stop function reports false if that has happened.
+func cancelOnDone(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stopCancel := cancelOnDone(ctx, conn)
+	defer stopCancel()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if authorization := proxyAuthorization(d.proxyURL.User); authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, fmt.Errorf("upstream proxy CONNECT: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return nil, fmt.Errorf("upstream proxy CONNECT: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		conn.Close()
+		return nil, &UpstreamProxyError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+		}
+	}
+
+	if !stopCancel() {
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reader.Buffered() > 0 {
+		return &bufferedReadConn{
+			Conn:   conn,
+			reader: reader,
+		}, nil
+	}
+	return conn, nil
+}
+
+// transport sends plain HTTP requests to the upstream proxy. Connections come
+// from dialProxy, so the transport treats an https:// proxy as plaintext.
+func (d *httpConnectDialer) transport() *http.Transport {
+	proxyURL := *d.proxyURL
+	proxyURL.Scheme = "http"
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		return withUpstreamUser(&proxyURL, upstreamAuthFrom(req.Context())), nil
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.dialProxy(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	return transport
+}
+
+func proxyAuthorization(user *url.Userinfo) string {
+	if user == nil {
+		return ""
+	}
+	password, _ := user.Password()
+	credentials := user.Username() + ":" + password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+}
+
+func dialErrorStatus(err error) int {
+	var proxyErr *UpstreamProxyError
+	if errors.As(err, &proxyErr) {
+		return http.StatusBadGateway
+	}
+	return http.StatusServiceUnavailable
+}
+
+func socks5DialErrorReply(err error) byte {
+	var proxyErr *UpstreamProxyError
+	if !errors.As(err, &proxyErr) {
+		return socks5GeneralFail
+	}
+	switch proxyErr.StatusCode {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return socks5NotAllowed
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return socks5HostUnreachable
+	}
+	return socks5GeneralFail
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+type connectProxyRequest struct {
+	target        string
+	authorization string
+}
+
+func newHTTPConnectProxy(t *testing.T, status int, tlsConfig *tls.Config) (string, <-chan connectProxyRequest) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	requests := make(chan connectProxyRequest, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveHTTPConnectProxyConn(conn, status, requests)
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+func serveHTTPConnectProxyConn(conn net.Conn, status int, requests chan<- connectProxyRequest) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil || req.Method != http.MethodConnect {
+		return
+	}
+	requests <- connectProxyRequest{
+		target:        req.Host,
+		authorization: req.Header.Get("Proxy-Authorization"),
+	}
+	resp := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+	}
+	if err := resp.Write(conn); err != nil || status != http.StatusOK {
+		return
+	}
+	_, _ = io.Copy(conn, reader)
+}
+
+func TestUpstreamDialerHTTPConnect(t *testing.T) {
+	proxyAddr, requests := newHTTPConnectProxy(t, http.StatusOK, nil)
+
+	upstream, err := NewUpstreamDialer("http://user:pass@"+proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer() error = %v", err)
+	}
+	conn, err := upstream.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	request := <-requests
+	if request.target != "example.com:443" {
+		t.Fatalf("CONNECT target = %q, want example.com:443", request.target)
+	}
+	if request.authorization != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("Proxy-Authorization = %q, want Basic user:pass", request.authorization)
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echo = %q, want ping", got)
+	}
+
+	transport, ok := upstream.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("upstream.Transport = %T, want *http.Transport", upstream.Transport)
+	}
+	proxyURL, err := transport.Proxy(&http.Request{})
+	if err != nil || proxyURL == nil || proxyURL.Scheme != "http" {
+		t.Fatalf("transport proxy = %v, %v; want http proxy", proxyURL, err)
+	}
+}
+
+func TestUpstreamDialerHTTPConnectRejected(t *testing.T) {
+	proxyAddr, requests := newHTTPConnectProxy(t, http.StatusProxyAuthRequired, nil)
+
+	upstream, err := NewUpstreamDialer("http://"+proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer() error = %v", err)
+	}
+	conn, err := upstream.Dial("tcp", "example.com:443")
+	if err == nil {
+		conn.Close()
+		t.Fatal("expected CONNECT error")
+	}
+	if request := <-requests; request.authorization != "" {
+		t.Fatalf("Proxy-Authorization = %q, want none without credentials", request.authorization)
+	}
+
+	var proxyErr *UpstreamProxyError
+	if !errors.As(err, &proxyErr) || proxyErr.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("error = %v, want UpstreamProxyError 407", err)
+	}
+}
+
+func TestUpstreamDialerHTTPConnectHonorsContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				conn.Close()
+			})
+		}
+	}()
+
+	upstream, err := NewUpstreamDialer("http://"+listener.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer() error = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	conn, err := upstream.DialContext(ctx, "tcp", "example.com:443")
+	if err == nil {
+		conn.Close()
+		t.Fatal("DialContext() to a silent upstream succeeded")
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("DialContext() error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("DialContext() returned after %s, want it cut off by the context", elapsed)
+	}
+}
+
+func TestHandleTunnelingReportsUpstreamProxyRejection(t *testing.T) {
+	proxy := NewProxy(func(network, addr string) (net.Conn, error) {
+		return nil, &UpstreamProxyError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}
+	}, nil, nil)
+
+	clientConn, clientPeer := net.Pipe()
+	defer clientConn.Close()
+	defer clientPeer.Close()
+
+	rec := &hijackResponseRecorder{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             clientConn,
+	}
+	req := httptest.NewRequest(http.MethodConnect, "http://example.com:443", nil)
+	req.Host = "example.com:443"
+	proxy.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadGateway {
+		t.Fatalf("status code = %d, want %d", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestSOCKS5DialErrorReply(t *testing.T) {
+	tests := []struct {
+		err  error
+		want byte
+	}{
+		{errors.New("connection refused"), socks5GeneralFail},
+		{&UpstreamProxyError{StatusCode: http.StatusProxyAuthRequired}, socks5NotAllowed},
+		{&UpstreamProxyError{StatusCode: http.StatusForbidden}, socks5NotAllowed},
+		{&UpstreamProxyError{StatusCode: http.StatusBadGateway}, socks5HostUnreachable},
+		{&UpstreamProxyError{StatusCode: http.StatusTeapot}, socks5GeneralFail},
+	}
+	for _, test := range tests {
+		if got := socks5DialErrorReply(test.err); got != test.want {
+			t.Fatalf("socks5DialErrorReply(%v) = %#x, want %#x", test.err, got, test.want)
+		}
+	}
+}
+
+func TestUpstreamDialerHTTPRejectsUDP(t *testing.T) {
+	upstream, err := NewUpstreamDialer("http://127.0.0.1:3128", time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer() error = %v", err)
+	}
+	if _, err := upstream.ListenUDP(context.Background()); err == nil {
+		t.Fatal("expected UDP relay error for HTTP upstream")
+	}
+}
+
+func TestUpstreamDialerHTTPSProxyVerifiesAndPresentsClientCertificate(t *testing.T) {
+	serverCert := localTLSCertificate(t)
+	clientCert := localTLSCertificate(t)
+	serverLeaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse server certificate: %v", err)
+	}
+	clientLeaf, err := x509.ParseCertificate(clientCert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse client certificate: %v", err)
+	}
+	proxyAddr, requests := newHTTPConnectProxy(t, http.StatusOK, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || string(rawCerts[0]) != string(clientLeaf.Raw) {
+				return errors.New("unexpected client certificate")
+			}
+			return nil
+		},
+	})
+
+	unverified, err := NewUpstreamDialer("https://"+proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("NewUpstreamDialer() error = %v", err)
+	}
+	if conn, err := unverified.Dial("tcp", "example.com:443"); err == nil {
+		conn.Close()
+		t.Fatal("expected certificate verification error without the proxy CA")
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverLeaf)
+	upstream, err := NewUpstreamDialerWithTLS("https://user:pass@"+proxyAddr, time.Second, &UpstreamTLS{
+		Config: &tls.Config{
+			RootCAs:      roots,
+			ServerName:   "upstream.test",
+			Certificates: []tls.Certificate{clientCert},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUpstreamDialerWithTLS() error = %v", err)
+	}
+	conn, err := upstream.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	request := <-requests
+	if request.target != "example.com:443" || request.authorization != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("CONNECT request = %+v, want example.com:443 with Basic auth", request)
+	}
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echo = %q, want ping", got)
+	}
+}
+
+func TestUpstreamDialerHTTPSProxyUsesUTLSFingerprint(t *testing.T) {
+	proxyAddr, results := newJA3CaptureTLSServer(t)
+
+	upstream, err := NewUpstreamDialerWithTLS("https://"+proxyAddr, time.Second, &UpstreamTLS{
+		Config: &tls.Config{
+			InsecureSkipVerify: true,
+			ServerName:         "proxy.test",
+		},
+		Fingerprint: &TLSFingerprint{
+			Client:  utls.HelloFirefox_63.Client,
+			Version: utls.HelloFirefox_63.Version,
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUpstreamDialerWithTLS() error = %v", err)
+	}
+	if conn, err := upstream.Dial("tcp", "example.com:443"); err == nil {
+		conn.Close()
+	}
+
+	result := receiveJA3CaptureResult(t, results)
+	if result.serverName != "proxy.test" {
+		t.Fatalf("proxy SNI = %q, want proxy.test", result.serverName)
+	}
+	expected := expectedUTLSJA3Fingerprint(t, utls.HelloFirefox_63, "proxy.test", []string{"http/1.1"})
+	if result.ja3Fingerprint != expected {
+		t.Fatalf("proxy JA3 = %s (%s), want Firefox_63 %s", result.ja3Fingerprint, result.ja3, expected)
+	}
+}
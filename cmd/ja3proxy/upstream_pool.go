@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	upstreamRoundRobin   = "round-robin"
+	upstreamRandom       = "random"
+	upstreamLeastConn    = "least-conn"
+	upstreamStickyClient = "sticky-client"
+	upstreamStickyHost   = "sticky-host"
+)
+
+var errNoUpstream = errors.New("no healthy upstream proxy")
+
+type upstreamClientKey struct{}
+
+func withUpstreamClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, upstreamClientKey{}, client)
+}
+
+func upstreamClientFrom(ctx context.Context) string {
+	client, _ := ctx.Value(upstreamClientKey{}).(string)
+	return client
+}
+
+func splitUpstreams(value string) []string {
+	var upstreams []string
+	for _, upstream := range strings.Split(value, ",") {
+		if upstream = strings.TrimSpace(upstream); upstream != "" {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+	return upstreams
+}
+
+type UpstreamPoolOptions struct {
+	Strategy       string
+	HealthInterval time.Duration
+	HealthTarget   string
+	MaxFails       int
+	EjectTime      time.Duration
+	FailClosed     bool
+}
+
+type upstreamMember struct {
+	name      string
+	dialer    *UpstreamDialer
+	transport http.RoundTripper
+	active    atomic.Int64
+
+	// Guarded by UpstreamPool.mu.
+	healthy      bool
+	fails        int
+	ejectedUntil time.Time
+}
+
+// UpstreamPool spreads connections over several upstream proxies, skipping
+// the ones that fail health checks or keep failing to dial.
+type UpstreamPool struct {
+	options UpstreamPoolOptions
+	members []*upstreamMember
+	direct  *UpstreamDialer
+	next    atomic.Uint64
+
+	mu sync.Mutex
+}
+
+func NewUpstreamPool(upstreams []string, timeout time.Duration, proxyTLS *UpstreamTLS, options UpstreamPoolOptions) (*UpstreamPool, error) {
+	switch options.Strategy {
+	case "":
+		options.Strategy = upstreamRoundRobin
+	case upstreamRoundRobin, upstreamRandom, upstreamLeastConn, upstreamStickyClient, upstreamStickyHost:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q, want round-robin, random, least-conn, sticky-client or sticky-host", options.Strategy)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream proxies")
+	}
+
+	pool := &UpstreamPool{options: options}
+	for _, upstream := range upstreams {
+		dialer, err := NewUpstreamDialerWithTLS(upstream, timeout, proxyTLS)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %w", upstream, err)
+		}
+		if dialer.proxyURL == nil {
+			return nil, fmt.Errorf("upstream %q is not a proxy", upstream)
+		}
+		member := &upstreamMember{
+			name:    dialer.proxyURL.Redacted(),
+			dialer:  dialer,
+			healthy: true,
+		}
+		member.transport = member.trackTransport(dialer.Transport)
+		pool.members = append(pool.members, member)
+	}
+
+	direct, err := NewUpstreamDialer("", timeout)
+	if err != nil {
+		return nil, err
+	}
+	pool.direct = direct
+	return pool, nil
+}
+
+// Start runs active health checks until ctx is done.
+func (pool *UpstreamPool) Start(ctx context.Context) {
+	if pool.options.HealthInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(pool.options.HealthInterval)
+		defer ticker.Stop()
+
+		for {
+			pool.checkHealth()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (pool *UpstreamPool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, member := range pool.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.setHealth(member, pool.probe(member))
+		}()
+	}
+	wg.Wait()
+}
+
+// probe dials the health target through the upstream, or just the upstream
+// itself when no target is configured. The whole probe, including the
+// upstream handshake, is bounded by the member's dial timeout.
+func (pool *UpstreamPool) probe(member *upstreamMember) error {
+	ctx, cancel := context.WithTimeout(context.Background(), member.dialer.timeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	if pool.options.HealthTarget != "" {
+		conn, err = member.dialer.DialContext(ctx, "tcp", pool.options.HealthTarget)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", member.dialer.proxyURL.Host)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (pool *UpstreamPool) setHealth(member *upstreamMember, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	healthy := err == nil
+	if healthy != member.healthy {
+		if healthy {
+			log.Printf("upstream %s is healthy again", member.name)
+		} else {
+			log.Printf("upstream %s failed health check: %v", member.name, err)
+		}
+	}
+	member.healthy = healthy
+	if healthy {
+		member.fails = 0
+		member.ejectedUntil = time.Time{}
+	}
+}
+
+// report counts consecutive failures to reach an upstream and ejects it once
+// they reach MaxFails. Errors from the target behind the proxy do not count.
+func (pool *UpstreamPool) report(member *upstreamMember, err error) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if err == nil {
+		member.fails = 0
+		return
+	}
+	if pool.options.MaxFails <= 0 || !isUpstreamUnreachable(err) {
+		return
+	}
+	member.fails++
+	if member.fails >= pool.options.MaxFails {
+		member.fails = 0
+		member.ejectedUntil = time.Now().Add(pool.options.EjectTime)
+		log.Printf("upstream %s ejected for %s after %d dial failures", member.name, pool.options.EjectTime, pool.options.MaxFails)
+	}
+}
+
+// candidates lists the usable upstreams in the order they should be tried.
+// A session goes back to the upstream it is pinned to while that is usable.
+func (pool *UpstreamPool) candidates(client, host string, session *upstreamSession) []*upstreamMember {
+	now := time.Now()
+	var members []*upstreamMember
+	pool.mu.Lock()
+	for _, member := range pool.members {
+		if member.healthy && !now.Before(member.ejectedUntil) {
+			members = append(members, member)
+		}
+	}
+	pool.mu.Unlock()
+	if len(members) == 0 {
+		return nil
+	}
+
+	if pinned := session.Upstream(); session != nil && session.id != "" {
+		sortByRendezvous(members, session.key)
+		for i, member := range members {
+			if member.name == pinned {
+				copy(members[1:i+1], members[:i])
+				members[0] = member
+				break
+			}
+		}
+		return members
+	}
+
+	switch pool.options.Strategy {
+	case upstreamRandom:
+		rand.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+	case upstreamLeastConn:
+		sort.SliceStable(members, func(i, j int) bool {
+			return members[i].active.Load() < members[j].active.Load()
+		})
+	case upstreamStickyClient:
+		sortByRendezvous(members, stripPort(client))
+	case upstreamStickyHost:
+		sortByRendezvous(members, host)
+	default:
+		start := int((pool.next.Add(1) - 1) % uint64(len(members)))
+		members = append(append([]*upstreamMember{}, members[start:]...), members[:start]...)
+	}
+	return members
+}
+
+// sortByRendezvous orders members by their hash with key, so a key keeps its
+// upstream while that upstream is usable and only its keys move when it is not.
+func sortByRendezvous(members []*upstreamMember, key string) {
+	weights := make(map[*upstreamMember]uint64, len(members))
+	for _, member := range members {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(member.name))
+		weights[member] = hash.Sum64()
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return weights[members[i]] > weights[members[j]]
+	})
+}
+
+func (pool *UpstreamPool) Dial(network, addr string) (net.Conn, error) {
+	return pool.DialContext(context.Background(), network, addr)
+}
+
+// DialContext tries the upstreams in strategy order, failing over while the
+// proxies themselves are unreachable.
+func (pool *UpstreamPool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var lastErr error
+	session := upstreamSessionFrom(ctx)
+	for _, member := range pool.candidates(upstreamClientFrom(ctx), stripPort(addr), session) {
+		conn, err := member.dialer.DialContext(ctx, network, addr)
+		pool.report(member, err)
+		if err == nil {
+			session.Pin(member.name)
+			return member.track(conn), nil
+		}
+		if !isUpstreamUnreachable(err) {
+			return nil, err
+		}
+		log.Printf("upstream %s dial error, trying next: %v", member.name, err)
+		lastErr = err
+	}
+
+	if err := pool.noUpstream(lastErr); err != nil {
+		return nil, err
+	}
+	return pool.direct.DialContext(ctx, network, addr)
+}
+
+func (pool *UpstreamPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var lastErr error
+	session := upstreamSessionFrom(req.Context())
+	for _, member := range pool.candidates(upstreamClientFrom(req.Context()), req.URL.Hostname(), session) {
+		resp, err := member.transport.RoundTrip(req)
+		pool.report(member, err)
+		if err == nil {
+			session.Pin(member.name)
+			return resp, nil
+		}
+		// The transport consumes the body, so only bodyless requests can move
+		// on to the next upstream.
+		if !isUpstreamUnreachable(err) || (req.Body != nil && req.Body != http.NoBody) {
+			return nil, err
+		}
+		log.Printf("upstream %s request error, trying next: %v", member.name, err)
+		lastErr = err
+	}
+
+	if err := pool.noUpstream(lastErr); err != nil {
+		return nil, err
+	}
+	return pool.direct.Transport.RoundTrip(req)
+}
+
+func (pool *UpstreamPool) ListenUDP(ctx context.Context) (udpEgress, error) {
+	var lastErr error
+	var hasSOCKS5 bool
+	for _, member := range pool.members {
+		hasSOCKS5 = hasSOCKS5 || member.dialer.proxyURL.Scheme == "socks5"
+	}
+	if !hasSOCKS5 {
+		return nil, fmt.Errorf("UDP relay needs a SOCKS5 upstream")
+	}
+	for _, member := range pool.candidates(upstreamClientFrom(ctx), "", upstreamSessionFrom(ctx)) {
+		if member.dialer.proxyURL.Scheme != "socks5" {
+			continue
+		}
+		egress, err := member.dialer.ListenUDP(ctx)
+		if err == nil {
+			return egress, nil
+		}
+		log.Printf("upstream %s UDP error, trying next: %v", member.name, err)
+		lastErr = err
+	}
+
+	if err := pool.noUpstream(lastErr); err != nil {
+		return nil, err
+	}
+	return pool.direct.ListenUDP(ctx)
+}
+
+// noUpstream returns the error to report once every upstream has been tried,
+// or nil when the pool may fall back to a direct connection.
+func (pool *UpstreamPool) noUpstream(lastErr error) error {
+	if pool.options.FailClosed {
+		if lastErr != nil {
+			return fmt.Errorf("%w: %w", errNoUpstream, lastErr)
+		}
+		return errNoUpstream
+	}
+	log.Printf("all upstream proxies are down, connecting directly")
+	return nil
+}
+
+// trackTransport counts the transport's connections towards least-conn and
+// marks failures to reach the proxy so they are ejected and failed over.
+func (member *upstreamMember) trackTransport(roundTripper http.RoundTripper) http.RoundTripper {
+	transport, ok := roundTripper.(*http.Transport)
+	if !ok {
+		return roundTripper
+	}
+	transport = transport.Clone()
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: member.dialer.timeout}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, upstreamUnreachable(member.dialer.proxyURL.Host, err)
+		}
+		return member.track(conn), nil
+	}
+	return transport
+}
+
+func (member *upstreamMember) track(conn net.Conn) net.Conn {
+	member.active.Add(1)
+	return &upstreamPoolConn{
+		Conn:   conn,
+		member: member,
+	}
+}
+
+type upstreamPoolConn struct {
+	net.Conn
+	member *upstreamMember
+	once   sync.Once
+}
+
+func (conn *upstreamPoolConn) Close() error {
+	conn.once.Do(func() {
+		conn.member.active.Add(-1)
+	})
+	return conn.Conn.Close()
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func closedProxyAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func newTestUpstreamPool(t *testing.T, upstreams []string, options UpstreamPoolOptions) *UpstreamPool {
+	t.Helper()
+
+	pool, err := NewUpstreamPool(upstreams, time.Second, nil, options)
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() error = %v", err)
+	}
+	return pool
+}
+
+func dialThroughPool(t *testing.T, pool *UpstreamPool, client string) {
+	t.Helper()
+
+	conn, err := pool.DialContext(withUpstreamClient(context.Background(), client), "tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("DialContext() error = %v", err)
+	}
+	conn.Close()
+}
+
+func receivedConnect(t *testing.T, requests <-chan connectProxyRequest) bool {
+	t.Helper()
+
+	select {
+	case <-requests:
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+func TestNewUpstreamPoolValidatesStrategy(t *testing.T) {
+	_, err := NewUpstreamPool([]string{"socks5://127.0.0.1:1080", "socks5://127.0.0.1:1081"}, time.Second, nil, UpstreamPoolOptions{Strategy: "fastest"})
+	if err == nil {
+		t.Fatal("expected unknown strategy error")
+	}
+}
+
+func TestSplitUpstreams(t *testing.T) {
+	got := splitUpstreams(" socks5://a:1080, ,http://b:3128 ")
+	if len(got) != 2 || got[0] != "socks5://a:1080" || got[1] != "http://b:3128" {
+		t.Fatalf("splitUpstreams() = %q", got)
+	}
+}
+
+func TestUpstreamPoolRoundRobin(t *testing.T) {
+	firstAddr, firstRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	secondAddr, secondRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	pool := newTestUpstreamPool(t, []string{"http://" + firstAddr, "http://" + secondAddr}, UpstreamPoolOptions{})
+
+	for i := 0; i < 2; i++ {
+		dialThroughPool(t, pool, "")
+		if !receivedConnect(t, firstRequests) {
+			t.Fatalf("dial %d did not use the first upstream", 2*i)
+		}
+		dialThroughPool(t, pool, "")
+		if !receivedConnect(t, secondRequests) {
+			t.Fatalf("dial %d did not use the second upstream", 2*i+1)
+		}
+	}
+}
+
+func TestUpstreamPoolLeastConn(t *testing.T) {
+	firstAddr, firstRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	secondAddr, secondRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	pool := newTestUpstreamPool(t, []string{"http://" + firstAddr, "http://" + secondAddr}, UpstreamPoolOptions{Strategy: upstreamLeastConn})
+
+	held, err := pool.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer held.Close()
+	if !receivedConnect(t, firstRequests) {
+		t.Fatal("first dial did not use the first upstream")
+	}
+
+	dialThroughPool(t, pool, "")
+	if !receivedConnect(t, secondRequests) {
+		t.Fatal("second dial did not use the idle upstream")
+	}
+	if got := pool.members[0].active.Load(); got != 1 {
+		t.Fatalf("first upstream active = %d, want 1", got)
+	}
+	if got := pool.members[1].active.Load(); got != 0 {
+		t.Fatalf("second upstream active = %d after close, want 0", got)
+	}
+}
+
+func TestUpstreamPoolStickyClient(t *testing.T) {
+	firstAddr, _ := newHTTPConnectProxy(t, http.StatusOK, nil)
+	secondAddr, _ := newHTTPConnectProxy(t, http.StatusOK, nil)
+	thirdAddr, _ := newHTTPConnectProxy(t, http.StatusOK, nil)
+	pool := newTestUpstreamPool(t, []string{"http://" + firstAddr, "http://" + secondAddr, "http://" + thirdAddr}, UpstreamPoolOptions{Strategy: upstreamStickyClient})
+
+	want := pool.candidates("203.0.113.7:1000", "example.com", nil)[0]
+	for _, client := range []string{"203.0.113.7:2000", "203.0.113.7:3000"} {
+		if got := pool.candidates(client, "other.example", nil)[0]; got != want {
+			t.Fatalf("client %s got upstream %s, want %s", client, got.name, want.name)
+		}
+	}
+
+	pool.setHealth(want, errors.New("down"))
+	moved := pool.candidates("203.0.113.7:1000", "example.com", nil)
+	if len(moved) != 2 || moved[0] == want {
+		t.Fatalf("candidates after health failure = %d, first %s", len(moved), moved[0].name)
+	}
+}
+
+func TestUpstreamPoolFailsOverAndEjects(t *testing.T) {
+	deadAddr := closedProxyAddr(t)
+	liveAddr, liveRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	pool := newTestUpstreamPool(t, []string{"http://" + deadAddr, "http://" + liveAddr}, UpstreamPoolOptions{
+		MaxFails:  1,
+		EjectTime: time.Minute,
+	})
+
+	dialThroughPool(t, pool, "")
+	if !receivedConnect(t, liveRequests) {
+		t.Fatal("dial did not fail over to the live upstream")
+	}
+	candidates := pool.candidates("", "", nil)
+	if len(candidates) != 1 || candidates[0] != pool.members[1] {
+		t.Fatalf("candidates after dial failure = %d, want only the live upstream", len(candidates))
+	}
+
+	pool.setHealth(pool.members[0], nil)
+	if got := len(pool.candidates("", "", nil)); got != 2 {
+		t.Fatalf("candidates after passing health check = %d, want 2", got)
+	}
+}
+
+func TestUpstreamPoolDoesNotEjectOnTargetErrors(t *testing.T) {
+	proxyAddr, requests := newHTTPConnectProxy(t, http.StatusBadGateway, nil)
+	liveAddr, liveRequests := newHTTPConnectProxy(t, http.StatusOK, nil)
+	pool := newTestUpstreamPool(t, []string{"http://" + proxyAddr, "http://" + liveAddr}, UpstreamPoolOptions{MaxFails: 1})
+
+	_, err := pool.Dial("tcp", "example.com:443")
+	var proxyErr *UpstreamProxyError
+	if !errors.As(err, &proxyErr) {
+		t.Fatalf("Dial() error = %v, want UpstreamProxyError", err)
+	}
+	if !receivedConnect(t, requests) {
+		t.Fatal("dial did not reach the first upstream")
+	}
+	if receivedConnect(t, liveRequests) {
+		t.Fatal("target error failed over to the next upstream")
+	}
+	if got := len(pool.candidates("", "", nil)); got != 2 {
+		t.Fatalf("candidates = %d, want 2", got)
+	}
+}
+
+func TestUpstreamPoolHealthCheck(t *testing.T) {
+	deadAddr := closedProxyAddr(t)
+	liveAddr, _ := newHTTPConnectProxy(t, http.StatusOK, nil)
+	pool := newTestUpstreamPool(t, []string{"http://" + deadAddr, "http://" + liveAddr}, UpstreamPoolOptions{})
+
+	pool.checkHealth()
+	if pool.members[0].healthy || !pool.members[1].healthy {
+		t.Fatalf("health = %v, %v; want false, true", pool.members[0].healthy, pool.members[1].healthy)
+	}
+}
+
+func TestUpstreamPoolHealthCheckTimesOutSilentUpstream(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				conn.Close()
+			})
+		}
+	}()
+
+	liveAddr, _ := newHTTPConnectProxy(t, http.StatusOK, nil)
+	upstreams := []string{"socks5://" + listener.Addr().String(), "http://" + liveAddr}
+	pool, err := NewUpstreamPool(upstreams, 200*time.Millisecond, nil, UpstreamPoolOptions{HealthTarget: "example.com:443"})
+	if err != nil {
+		t.Fatalf("NewUpstreamPool() error = %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pool.checkHealth()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("checkHealth() blocked on an upstream that never answers")
+	}
+	if pool.members[0].healthy || !pool.members[1].healthy {
+		t.Fatalf("health = %v, %v; want false, true", pool.members[0].healthy, pool.members[1].healthy)
+	}
+}
+
+func TestUpstreamPoolAllDown(t *testing.T) {
+	upstreams := []string{"http://" + closedProxyAddr(t), "http://" + closedProxyAddr(t)}
+	target := newTCPEchoServer(t)
+
+	closed := newTestUpstreamPool(t, upstreams, UpstreamPoolOptions{FailClosed: true})
+	if _, err := closed.Dial("tcp", target); !errors.Is(err, errNoUpstream) {
+		t.Fatalf("fail-closed Dial() error = %v, want errNoUpstream", err)
+	}
+
+	open := newTestUpstreamPool(t, upstreams, UpstreamPoolOptions{})
+	conn, err := open.Dial("tcp", target)
+	if err != nil {
+		t.Fatalf("fail-open Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("set deadline: %v", err)
+	}
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "ping" {
+		t.Fatalf("direct echo = %q, %v; want ping", got, err)
+	}
+}
+
+func TestUpstreamPoolRoundTripFailsOver(t *testing.T) {
+	forwardProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "proxied "+r.URL.String())
+	}))
+	defer forwardProxy.Close()
+	pool := newTestUpstreamPool(t, []string{"http://" + closedProxyAddr(t), forwardProxy.URL}, UpstreamPoolOptions{
+		MaxFails:  1,
+		EjectTime: time.Minute,
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	resp, err := pool.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "proxied http://example.com/" {
+		t.Fatalf("body = %q, want the forward proxy response", body)
+	}
+	if got := len(pool.candidates("", "", nil)); got != 1 {
+		t.Fatalf("candidates = %d, want the dead upstream ejected", got)
+	}
+}